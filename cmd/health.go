@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/cmd/event"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+// ensureDisksHealthy prevents a installation onto disks which are already failing.
+// Disks without smart data are considered healthy.
+func (h *Hammer) ensureDisksHealthy(disks []*models.ModelsV1MachineBlockDevice) error {
+	unhealthy := []string{}
+	for _, disk := range disks {
+		if disk.Health == nil || disk.Health.Healthy == nil || *disk.Health.Healthy {
+			continue
+		}
+		unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", *disk.Name, strings.Join(disk.Health.Reasons, ", ")))
+	}
+	if len(unhealthy) == 0 {
+		return nil
+	}
+	if h.Spec.DevMode {
+		log.Warn("unhealthy disks found, ignoring in devmode", "disks", unhealthy)
+		return nil
+	}
+	err := fmt.Errorf("unhealthy disks found: %s", strings.Join(unhealthy, ", "))
+	h.EventEmitter.Emit(event.ProvisioningEventUnhealthyDisks, err.Error())
+	return err
+}
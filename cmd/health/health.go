@@ -0,0 +1,200 @@
+package health
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+// Thresholds define at which values a disk is considered to be unhealthy.
+type Thresholds struct {
+	// ReallocatedSectors is the maximum number of reallocated sectors of a ata disk
+	ReallocatedSectors int64
+	// PendingSectors is the maximum number of sectors waiting to be remapped of a ata disk
+	PendingSectors int64
+	// UncorrectableSectors is the maximum number of offline uncorrectable sectors of a ata disk
+	UncorrectableSectors int64
+	// MediaErrors is the maximum number of unrecovered data integrity errors of a nvme disk
+	MediaErrors int64
+	// PercentageUsed is the maximum vendor estimate of the consumed life time of a nvme disk
+	PercentageUsed int64
+}
+
+// DefaultThresholds are used to decide if a disk is still usable for a installation.
+var DefaultThresholds = Thresholds{
+	ReallocatedSectors:   100,
+	PendingSectors:       0,
+	UncorrectableSectors: 0,
+	MediaErrors:          0,
+	PercentageUsed:       99,
+}
+
+// Assessment is the health state of a single disk
+type Assessment struct {
+	Device               string
+	Healthy              bool
+	SelfAssessmentPassed bool
+	ReallocatedSectors   int64
+	PendingSectors       int64
+	UncorrectableSectors int64
+	MediaErrors          int64
+	PercentageUsed       int64
+	CriticalWarning      int64
+	// Reasons contains every threshold which was exceeded
+	Reasons []string
+}
+
+// nvmeSmartLog contains the relevant fields of: nvme smart-log -o json
+type nvmeSmartLog struct {
+	CriticalWarning int64 `json:"critical_warning"`
+	AvailSpare      int64 `json:"avail_spare"`
+	SpareThresh     int64 `json:"spare_thresh"`
+	PercentUsed     int64 `json:"percent_used"`
+	MediaErrors     int64 `json:"media_errors"`
+}
+
+// Check reads the smart attributes of the given disk device and evaluates them with the DefaultThresholds.
+// Nil is returned without error if smartctl is not available, the disk has no smart data then.
+func Check(device string) (*Assessment, error) {
+	var (
+		a   *Assessment
+		err error
+	)
+	if strings.HasPrefix(device, "/dev/nvme") {
+		a, err = readNVMe(device)
+	} else {
+		a, err = readSmartCtl(device)
+	}
+	if err != nil || a == nil {
+		return nil, err
+	}
+	DefaultThresholds.Evaluate(a)
+	log.Info("disk health", "device", device, "healthy", a.Healthy, "reasons", a.Reasons)
+	return a, nil
+}
+
+// Evaluate compares the attributes of a assessment against the thresholds
+// and sets the healthy state and the reasons accordingly.
+func (t Thresholds) Evaluate(a *Assessment) {
+	a.Reasons = []string{}
+	if !a.SelfAssessmentPassed {
+		a.Reasons = append(a.Reasons, "self assessment failed")
+	}
+	if a.ReallocatedSectors > t.ReallocatedSectors {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("reallocated sectors %d exceed %d", a.ReallocatedSectors, t.ReallocatedSectors))
+	}
+	if a.PendingSectors > t.PendingSectors {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("pending sectors %d exceed %d", a.PendingSectors, t.PendingSectors))
+	}
+	if a.UncorrectableSectors > t.UncorrectableSectors {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("uncorrectable sectors %d exceed %d", a.UncorrectableSectors, t.UncorrectableSectors))
+	}
+	if a.MediaErrors > t.MediaErrors {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("media errors %d exceed %d", a.MediaErrors, t.MediaErrors))
+	}
+	if a.PercentageUsed > t.PercentageUsed {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("percentage used %d exceeds %d", a.PercentageUsed, t.PercentageUsed))
+	}
+	if a.CriticalWarning != 0 {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("critical warning 0x%x is set", a.CriticalWarning))
+	}
+	a.Healthy = len(a.Reasons) == 0
+}
+
+func readNVMe(device string) (*Assessment, error) {
+	path, err := exec.LookPath(command.NVME)
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate program:%s in path %w", command.NVME, err)
+	}
+	out, err := exec.Command(path, "smart-log", "-o", "json", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read smart-log of %s %w", device, err)
+	}
+	return parseNVMeSmartLog(device, out)
+}
+
+func parseNVMeSmartLog(device string, out []byte) (*Assessment, error) {
+	smartLog := &nvmeSmartLog{}
+	err := json.Unmarshal(out, smartLog)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse smart-log of %s %w", device, err)
+	}
+	return &Assessment{
+		Device:               device,
+		SelfAssessmentPassed: smartLog.AvailSpare >= smartLog.SpareThresh,
+		MediaErrors:          smartLog.MediaErrors,
+		PercentageUsed:       smartLog.PercentUsed,
+		CriticalWarning:      smartLog.CriticalWarning,
+	}, nil
+}
+
+func readSmartCtl(device string) (*Assessment, error) {
+	path, err := exec.LookPath(command.SmartCtl)
+	if err != nil {
+		log.Info("disk health", "device", device, "message", "smartctl not available, no smart data")
+		return nil, nil
+	}
+	out, err := exec.Command(path, "--health", "--attributes", device).Output()
+	// smartctl returns a bitmask as exit status, only bit 0 and 1 indicate that
+	// the device could not be queried at all, all other bits are evaluated by parsing the output.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode()&0x3 == 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read smart attributes of %s %w", device, err)
+	}
+	return parseSmartCtl(device, out)
+}
+
+// parseSmartCtl parses the output of smartctl --health --attributes:
+//
+//	SMART overall-health self-assessment test result: PASSED
+//	...
+//	ID# ATTRIBUTE_NAME          FLAG     VALUE WORST THRESH TYPE      UPDATED  WHEN_FAILED RAW_VALUE
+//	  5 Reallocated_Sector_Ct   0x0033   100   100   010    Pre-fail  Always       -       0
+//
+// sas disks only report "SMART Health Status: OK".
+func parseSmartCtl(device string, out []byte) (*Assessment, error) {
+	a := &Assessment{
+		Device: device,
+	}
+	healthFound := false
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "SMART overall-health self-assessment test result:") || strings.HasPrefix(line, "SMART Health Status:") {
+			healthFound = true
+			result := strings.TrimSpace(line[strings.LastIndex(line, ":")+1:])
+			a.SelfAssessmentPassed = result == "PASSED" || result == "OK"
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		raw, err := strconv.ParseInt(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "5":
+			a.ReallocatedSectors = raw
+		case "197":
+			a.PendingSectors = raw
+		case "198":
+			a.UncorrectableSectors = raw
+		}
+	}
+	if !healthFound {
+		return nil, fmt.Errorf("no smart health status found for %s", device)
+	}
+	return a, nil
+}
@@ -0,0 +1,107 @@
+package health
+
+import (
+	"reflect"
+	"testing"
+)
+
+const smartCtlOutput = `smartctl 6.6 2017-11-05 r4594 [x86_64-linux-4.19.0] (local build)
+Copyright (C) 2002-17, Bruce Allen, Christian Franke, www.smartmontools.org
+
+=== START OF READ SMART DATA SECTION ===
+SMART overall-health self-assessment test result: PASSED
+
+SMART Attributes Data Structure revision number: 1
+Vendor Specific SMART Attributes with Thresholds:
+ID# ATTRIBUTE_NAME          FLAG     VALUE WORST THRESH TYPE      UPDATED  WHEN_FAILED RAW_VALUE
+  5 Reallocated_Sector_Ct   0x0033   100   100   010    Pre-fail  Always       -       120
+  9 Power_On_Hours          0x0032   096   096   000    Old_age   Always       -       17583
+194 Temperature_Celsius     0x0022   067   051   000    Old_age   Always       -       33 (Min/Max 20/49)
+197 Current_Pending_Sector  0x0032   100   100   000    Old_age   Always       -       2
+198 Offline_Uncorrectable   0x0030   100   100   000    Old_age   Offline      -       0
+`
+
+func TestParseSmartCtl(t *testing.T) {
+	got, err := parseSmartCtl("/dev/sda", []byte(smartCtlOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Assessment{
+		Device:               "/dev/sda",
+		SelfAssessmentPassed: true,
+		ReallocatedSectors:   120,
+		PendingSectors:       2,
+		UncorrectableSectors: 0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSmartCtl() = %#v, want %#v", got, want)
+	}
+
+	_, err = parseSmartCtl("/dev/vda", []byte("/dev/vda: Unable to detect device type"))
+	if err == nil {
+		t.Error("expected error for output without health status")
+	}
+}
+
+func TestParseNVMeSmartLog(t *testing.T) {
+	out := `{"critical_warning":4,"temperature":308,"avail_spare":100,"spare_thresh":10,"percent_used":3,"media_errors":0}`
+	got, err := parseNVMeSmartLog("/dev/nvme0n1", []byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Assessment{
+		Device:               "/dev/nvme0n1",
+		SelfAssessmentPassed: true,
+		PercentageUsed:       3,
+		CriticalWarning:      4,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseNVMeSmartLog() = %#v, want %#v", got, want)
+	}
+}
+
+func TestThresholds_Evaluate(t *testing.T) {
+	tests := []struct {
+		name        string
+		assessment  Assessment
+		wantHealthy bool
+		wantReasons int
+	}{
+		{
+			name:        "healthy",
+			assessment:  Assessment{SelfAssessmentPassed: true, ReallocatedSectors: 10, PercentageUsed: 20},
+			wantHealthy: true,
+		},
+		{
+			name:        "self assessment failed",
+			assessment:  Assessment{SelfAssessmentPassed: false},
+			wantHealthy: false,
+			wantReasons: 1,
+		},
+		{
+			name:        "worn out nvme with media errors",
+			assessment:  Assessment{SelfAssessmentPassed: true, MediaErrors: 3, PercentageUsed: 100},
+			wantHealthy: false,
+			wantReasons: 2,
+		},
+		{
+			name:        "pending sectors and critical warning",
+			assessment:  Assessment{SelfAssessmentPassed: true, PendingSectors: 1, CriticalWarning: 1},
+			wantHealthy: false,
+			wantReasons: 2,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			a := tt.assessment
+			DefaultThresholds.Evaluate(&a)
+			if a.Healthy != tt.wantHealthy {
+				t.Errorf("Evaluate() healthy = %t, want %t", a.Healthy, tt.wantHealthy)
+			}
+			if len(a.Reasons) != tt.wantReasons {
+				t.Errorf("Evaluate() reasons = %v, want %d reasons", a.Reasons, tt.wantReasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// extended attributes which store posix acls, see include/uapi/linux/posix_acl_xattr.h
+const (
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+	aclXattrVersion = 2
+	// aclUndefinedID is the id of entries which do not refer to a user or group
+	aclUndefinedID = math.MaxUint32
+)
+
+// tags of acl entries in the order the kernel requires them
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// aclXattr converts a posix acl in text form to the binary form of its extended attribute. Entries are separated by
+// commas or newlines and have the form tag:qualifier:perms with an optional numeric id as fourth field, as written by
+// star and gnu tar, e.g. "user::rwx,user:jane:r-x:1000,group::r-x,mask::r-x,other::---".
+// An empty acl returns nil.
+func aclXattr(text string) ([]byte, error) {
+	entries := []aclEntry{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		// comments like the effective permissions follow a #
+		if i := strings.IndexByte(field, '#'); i >= 0 {
+			field = field[:i]
+		}
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("malformed acl entry %q", field)
+		}
+		entry := aclEntry{id: aclUndefinedID}
+		qualified := parts[1] != ""
+		switch {
+		case parts[0] == "user" && qualified:
+			entry.tag = aclUser
+		case parts[0] == "user":
+			entry.tag = aclUserObj
+		case parts[0] == "group" && qualified:
+			entry.tag = aclGroup
+		case parts[0] == "group":
+			entry.tag = aclGroupObj
+		case parts[0] == "mask":
+			entry.tag = aclMask
+		case parts[0] == "other":
+			entry.tag = aclOther
+		default:
+			return nil, fmt.Errorf("unknown acl tag in entry %q", field)
+		}
+		if qualified {
+			// names can not be resolved in the initrd, the numeric id is used
+			id := parts[1]
+			if len(parts) == 4 {
+				id = parts[3]
+			}
+			n, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("acl entry %q has no numeric id", field)
+			}
+			entry.id = uint32(n)
+		}
+		for i, p := range parts[2] {
+			switch {
+			case p == 'r' && i == 0:
+				entry.perm |= 4
+			case p == 'w' && i == 1:
+				entry.perm |= 2
+			case p == 'x' && i == 2:
+				entry.perm |= 1
+			case p == '-' && i < 3:
+			default:
+				return nil, fmt.Errorf("invalid permissions in acl entry %q", field)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	result := make([]byte, 4, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(result, aclXattrVersion)
+	for _, e := range entries {
+		var b [8]byte
+		binary.LittleEndian.PutUint16(b[0:], e.tag)
+		binary.LittleEndian.PutUint16(b[2:], e.perm)
+		binary.LittleEndian.PutUint32(b[4:], e.id)
+		result = append(result, b[:]...)
+	}
+	return result, nil
+}
@@ -0,0 +1,225 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// CacheDir is the directory images are prefetched into, it is located in the memory of the initrd
+const CacheDir = "/var/cache/metal-hammer/images"
+
+// Cache holds verified images which were prefetched while the machine waits for its allocation,
+// the installation of a cached image does not need to download it.
+type Cache struct {
+	dir string
+	// size is the maximum number of bytes of all cached images
+	size int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	used    int64
+	// current is the image which is prefetched right now
+	current string
+	stopped bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	// installed is the image which was passed to Stop, the cache lookup is only reported for it
+	installed string
+}
+
+type cacheEntry struct {
+	file     string
+	size     int64
+	checksum *checksum
+}
+
+// cachedImage is an image which is read from the cache instead of being downloaded
+type cachedImage struct {
+	*os.File
+	size int64
+}
+
+func (c *cachedImage) Size() int64 {
+	return c.size
+}
+
+// NewCache returns a cache which stores up to size bytes of images in dir.
+func NewCache(dir string, size int64) (*Cache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create image cache %s %w", dir, err)
+	}
+	return &Cache{
+		dir:     dir,
+		size:    size,
+		entries: make(map[string]*cacheEntry),
+	}, nil
+}
+
+// Prefetch pulls and verifies the given images, most likely first, into the cache in the background until Stop is called.
+// Images which do not fit into the cache and images in oci registries are skipped.
+func (c *Cache) Prefetch(d *Downloader, images []string, policy Policy) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.cancel = cancel
+	c.done = done
+	c.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		for _, image := range images {
+			if !c.next(image) {
+				return
+			}
+			begin := time.Now()
+			err := c.fetch(ctx, d, image, policy)
+			if err != nil {
+				log.Warn("image prefetch failed", "image", image, "error", err)
+				continue
+			}
+			log.Info("image prefetched", "image", image, "took", time.Since(begin))
+		}
+		c.next("")
+	}()
+}
+
+// next marks image as currently prefetched and returns false if prefetching was stopped.
+func (c *Cache) next(image string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return false
+	}
+	c.current = image
+	return true
+}
+
+// Stop ends prefetching, a running prefetch of image is completed before Stop returns, all others are aborted.
+// All cached images except image are removed to free the memory of the initrd for the installation.
+func (c *Cache) Stop(image string) {
+	c.mu.Lock()
+	c.stopped = true
+	c.installed = image
+	done := c.done
+	if c.current != image && c.cancel != nil {
+		c.cancel()
+	}
+	c.mu.Unlock()
+	if done != nil {
+		<-done
+		c.cancel()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, entry := range c.entries {
+		if name == image {
+			continue
+		}
+		err := os.Remove(entry.file)
+		if err != nil {
+			log.Warn("unable to remove cached image", "image", name, "error", err)
+		}
+		delete(c.entries, name)
+		c.used -= entry.size
+	}
+}
+
+// Contains returns true if the image is cached.
+func (c *Cache) Contains(image string) bool {
+	return c.lookup(image) != nil
+}
+
+// installs returns true if image was passed to Stop.
+func (c *Cache) installs(image string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopped && c.installed == image
+}
+
+func (c *Cache) lookup(image string) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[image]
+}
+
+// fetch downloads the image into the cache and verifies it like Burn does, the image is only cached if it matches its checksum.
+func (c *Cache) fetch(ctx context.Context, d *Downloader, image string, policy Policy) error {
+	if IsOCI(image) {
+		return fmt.Errorf("images in oci registries are not cached")
+	}
+	if c.Contains(image) {
+		return nil
+	}
+	sum, err := d.fetchChecksum(image, policy)
+	if err != nil {
+		return err
+	}
+	dl, err := d.open(image)
+	if err != nil {
+		return err
+	}
+	defer dl.Close()
+
+	c.mu.Lock()
+	free := c.size - c.used
+	c.mu.Unlock()
+	if dl.Size() > free {
+		return fmt.Errorf("image of %d bytes does not fit into the cache with %d bytes free", dl.Size(), free)
+	}
+
+	file := filepath.Join(c.dir, fmt.Sprintf("%x", sha256.Sum256([]byte(image))))
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	h := sum.algorithm.hash()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(&contextReader{ctx: ctx, r: dl}, free+1))
+	if err == nil && size > free {
+		err = fmt.Errorf("image does not fit into the cache with %d bytes free", free)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && fmt.Sprintf("%x", h.Sum(nil)) != sum.sum {
+		err = fmt.Errorf("%s mismatch of image %s", sum.algorithm.name, image)
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[image] = &cacheEntry{file: file, size: size, checksum: sum}
+	c.used += size
+	return nil
+}
+
+// contextReader aborts reading once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
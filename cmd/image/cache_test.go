@@ -0,0 +1,189 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// imageServer serves gzip compressed images with their sha256 checksums and counts the image requests
+type imageServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newImageServer(t *testing.T, images map[string][]byte, slow string) *imageServer {
+	s := &imageServer{requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(r.URL.Path, ".sha256")
+		image, ok := images[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if name != r.URL.Path {
+			_, _ = w.Write([]byte(fmt.Sprintf("%x  %s\n", sha256.Sum256(image), name)))
+			return
+		}
+		s.mu.Lock()
+		s.requests[name]++
+		s.mu.Unlock()
+		if name != slow {
+			_, _ = w.Write(image)
+			return
+		}
+		// the slow image takes until the request is aborted
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(image)))
+		for i := range image {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			_, _ = w.Write(image[i : i+1])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	return s
+}
+
+func (s *imageServer) count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[name]
+}
+
+func gzipped(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCachePrefetch(t *testing.T) {
+	image := gzipped(t, testTar(t))
+	server := newImageServer(t, map[string][]byte{"/a.tar.gz": image, "/b.tar.gz": image}, "")
+	defer server.Close()
+
+	cache, err := NewCache(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testDownloader(t)
+	a, b := server.URL+"/a.tar.gz", server.URL+"/b.tar.gz"
+	cache.Prefetch(d, []string{a, server.URL + "/missing.tar.gz", b}, Policy{})
+	deadline := time.Now().Add(5 * time.Second)
+	for !cache.Contains(b) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fileB := cache.lookup(b).file
+	cache.Stop(a)
+	if !cache.Contains(a) {
+		t.Fatalf("image was not prefetched")
+	}
+	if _, err := os.Stat(fileB); cache.Contains(b) || !os.IsNotExist(err) {
+		t.Errorf("image which is not installed was not removed from the cache")
+	}
+	if cache.used != cache.lookup(a).size {
+		t.Errorf("cache uses %d bytes, want %d", cache.used, cache.lookup(a).size)
+	}
+
+	hits := []bool{}
+	d.UseCache(cache, func(image string, hit bool) {
+		if image != a {
+			t.Errorf("cache lookup reported for %s, want %s", image, a)
+		}
+		hits = append(hits, hit)
+	})
+	prefix := t.TempDir()
+	_, err = d.Burn(prefix, a, nil, Policy{})
+	if err != nil {
+		t.Fatalf("Burn() error = %v", err)
+	}
+	if server.count("/a.tar.gz") != 1 {
+		t.Errorf("cached image was pulled %d times, want once", server.count("/a.tar.gz"))
+	}
+	content, err := os.ReadFile(filepath.Join(prefix, "etc", "hostname"))
+	if err != nil || string(content) != "metal-hammer" {
+		t.Errorf("etc/hostname = %q %v, want metal-hammer", content, err)
+	}
+
+	// an image which was replaced after it was prefetched is pulled again
+	cache.lookup(a).checksum = &checksum{algorithm: checksumAlgorithms[1], sum: "replaced"}
+	_, err = d.Burn(t.TempDir(), a, nil, Policy{})
+	if err != nil {
+		t.Fatalf("Burn() error = %v", err)
+	}
+	if server.count("/a.tar.gz") != 2 {
+		t.Errorf("replaced image was pulled %d times, want twice", server.count("/a.tar.gz"))
+	}
+	if !reflect.DeepEqual(hits, []bool{true, false}) {
+		t.Errorf("cache lookups reported %v, want a hit and a miss of the replaced image", hits)
+	}
+}
+
+func TestCacheStop(t *testing.T) {
+	image := gzipped(t, testTar(t))
+	server := newImageServer(t, map[string][]byte{"/slow.tar.gz": image, "/large.tar.gz": image}, "/slow.tar.gz")
+	defer server.Close()
+
+	cache, err := NewCache(t.TempDir(), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := server.URL + "/slow.tar.gz"
+	cache.Prefetch(testDownloader(t), []string{slow, server.URL + "/large.tar.gz"}, Policy{})
+	deadline := time.Now().Add(5 * time.Second)
+	for server.count("/slow.tar.gz") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	begin := time.Now()
+	cache.Stop(server.URL + "/other.tar.gz")
+	if time.Since(begin) > time.Second {
+		t.Errorf("Stop() waited %s for the prefetch of another image", time.Since(begin))
+	}
+	if cache.Contains(slow) {
+		t.Errorf("aborted prefetch was cached")
+	}
+	if server.count("/large.tar.gz") != 0 {
+		t.Errorf("prefetch continued after Stop()")
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	image := gzipped(t, testTar(t))
+	server := newImageServer(t, map[string][]byte{"/a.tar.gz": image}, "")
+	defer server.Close()
+
+	cache, err := NewCache(t.TempDir(), int64(len(image))-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.fetch(context.Background(), testDownloader(t), server.URL+"/a.tar.gz", Policy{})
+	if err == nil || !strings.Contains(err.Error(), "does not fit") {
+		t.Errorf("fetch() error = %v, want does not fit", err)
+	}
+	if cache.Contains(server.URL + "/a.tar.gz") {
+		t.Errorf("image larger than the cache was cached")
+	}
+}
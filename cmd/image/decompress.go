@@ -0,0 +1,126 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	lz4 "github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// compression of an image, detected by the magic bytes at the beginning of the image
+type compression string
+
+const (
+	compressionNone  = compression("none")
+	compressionLZ4   = compression("lz4")
+	compressionZstd  = compression("zstd")
+	compressionGzip  = compression("gzip")
+	compressionXZ    = compression("xz")
+	compressionBzip2 = compression("bzip2")
+)
+
+// magics are the leading bytes of every supported compression format
+var magics = []struct {
+	compression compression
+	magic       []byte
+}{
+	{compression: compressionLZ4, magic: []byte{0x04, 0x22, 0x4d, 0x18}},
+	{compression: compressionZstd, magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compression: compressionGzip, magic: []byte{0x1f, 0x8b}},
+	{compression: compressionXZ, magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{compression: compressionBzip2, magic: []byte{'B', 'Z', 'h'}},
+}
+
+const (
+	// tarMagicOffset is the position of the magic of posix and gnu tar headers
+	tarMagicOffset = 257
+	tarMagic       = "ustar"
+	// sniffLength is the number of bytes required to detect all supported formats
+	sniffLength = tarMagicOffset + len(tarMagic)
+)
+
+// magicCompression returns the compression whose magic the given bytes start with.
+func magicCompression(header []byte) (compression, bool) {
+	for _, m := range magics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.compression, true
+		}
+	}
+	return "", false
+}
+
+// detectCompression returns the compression of an image which starts with the given bytes,
+// an image which is not compressed must be a tar archive.
+func detectCompression(header []byte) (compression, error) {
+	if c, ok := magicCompression(header); ok {
+		return c, nil
+	}
+	if len(header) >= sniffLength && string(header[tarMagicOffset:sniffLength]) == tarMagic {
+		return compressionNone, nil
+	}
+	return "", fmt.Errorf("unsupported image format, expected a tar archive compressed with lz4, zstd, gzip, xz, bzip2 or none")
+}
+
+// detectRawCompression returns the compression of a raw disk image which starts with the given bytes,
+// a raw image which is not compressed has no magic.
+func detectRawCompression(header []byte) (compression, error) {
+	if c, ok := magicCompression(header); ok {
+		return c, nil
+	}
+	return compressionNone, nil
+}
+
+// decompress returns a reader of the uncompressed content of the given tar image stream,
+// the compression is detected from the content.
+func decompress(r io.Reader) (io.ReadCloser, compression, error) {
+	return decompressWith(r, detectCompression)
+}
+
+// decompressRaw returns a reader of the uncompressed content of the given raw disk image stream.
+func decompressRaw(r io.Reader) (io.ReadCloser, compression, error) {
+	return decompressWith(r, detectRawCompression)
+}
+
+func decompressWith(r io.Reader, detect func(header []byte) (compression, error)) (io.ReadCloser, compression, error) {
+	br := bufio.NewReaderSize(r, sniffLength)
+	header, err := br.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("unable to read image header %w", err)
+	}
+	c, err := detect(header)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch c {
+	case compressionLZ4:
+		return io.NopCloser(lz4.NewReader(br)), c, nil
+	case compressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, c, fmt.Errorf("unable to create zstd reader %w", err)
+		}
+		return zr.IOReadCloser(), c, nil
+	case compressionGzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, c, fmt.Errorf("unable to create gzip reader %w", err)
+		}
+		return gr, c, nil
+	case compressionXZ:
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, c, fmt.Errorf("unable to create xz reader %w", err)
+		}
+		return io.NopCloser(xr), c, nil
+	case compressionBzip2:
+		return io.NopCloser(bzip2.NewReader(br)), c, nil
+	}
+	return io.NopCloser(br), c, nil
+}
@@ -0,0 +1,133 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	lz4 "github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+func testTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := []byte("metal-hammer")
+	err := tw.WriteHeader(&tar.Header{Name: "etc/hostname", Mode: 0644, Size: int64(len(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tw.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	archive := testTar(t)
+
+	tests := []struct {
+		name     string
+		compress func(w io.Writer) (io.WriteCloser, error)
+		want     compression
+	}{
+		{
+			name:     "none",
+			compress: func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+			want:     compressionNone,
+		},
+		{
+			name:     "lz4",
+			compress: func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil },
+			want:     compressionLZ4,
+		},
+		{
+			name:     "zstd",
+			compress: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+			want:     compressionZstd,
+		},
+		{
+			name:     "gzip",
+			compress: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+			want:     compressionGzip,
+		},
+		{
+			name:     "xz",
+			compress: func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+			want:     compressionXZ,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := tt.compress(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = w.Write(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, got, err := decompress(&buf)
+			if err != nil {
+				t.Fatalf("decompress() error = %v", err)
+			}
+			defer r.Close()
+			if got != tt.want {
+				t.Errorf("decompress() compression = %v, want %v", got, tt.want)
+			}
+			content, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("decompress() read error = %v", err)
+			}
+			if !bytes.Equal(content, archive) {
+				t.Errorf("decompress() content differs from the archive")
+			}
+		})
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []byte
+		want    compression
+		wantErr bool
+	}{
+		{name: "bzip2", header: []byte("BZh91AY&SY"), want: compressionBzip2},
+		{name: "zstd", header: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x04}, want: compressionZstd},
+		{name: "zip is not supported", header: []byte("PK\x03\x04"), wantErr: true},
+		{name: "too short for tar", header: []byte("ustar"), wantErr: true},
+		{name: "empty", header: []byte{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectCompression(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectCompression() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("detectCompression() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,381 @@
+package image
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	// downloadAttempts is the number of consecutive failed requests across all mirrors before a download fails
+	downloadAttempts = 10
+	// maxBackoff is the longest time to wait before the next request
+	maxBackoff = 30 * time.Second
+)
+
+// Downloader downloads images and their checksum files, interrupted downloads are resumed
+// with range requests and fail over to the mirrors of the image.
+type Downloader struct {
+	client  *http.Client
+	mirrors []string
+	// backoff is the time to wait before the first retry, doubled for every further retry
+	backoff time.Duration
+	// stallTimeout aborts a request which did not receive any data for this duration
+	stallTimeout time.Duration
+	// cache provides prefetched images, which are burned without downloading them again
+	cache *Cache
+	// cacheReport is called with the result of the cache lookup of the installed image
+	cacheReport func(image string, hit bool)
+	// persistentCache provides images of previous installations and stores the burned images
+	persistentCache *PersistentCache
+}
+
+// NewDownloader returns a Downloader which fails over to the given mirrors, which are base urls serving the images
+// under the same path. Proxies are taken from the environment, the certificates of caBundle are trusted in addition
+// to the system certificates if given.
+func NewDownloader(mirrors []string, caBundle string) (*Downloader, error) {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unexpected default transport %T", http.DefaultTransport)
+	}
+	transport = transport.Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	if caBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca bundle %s %w", caBundle, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle %s", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return &Downloader{
+		client:       &http.Client{Transport: transport},
+		mirrors:      mirrors,
+		backoff:      time.Second,
+		stallTimeout: time.Minute,
+	}, nil
+}
+
+// UseCache burns images from the given cache if they were prefetched and match their current checksum.
+// The optional report is called with the result of the lookup of the image which was passed to Stop of the cache.
+func (d *Downloader) UseCache(c *Cache, report func(image string, hit bool)) {
+	d.cache = c
+	d.cacheReport = report
+}
+
+// UsePersistentCache burns images from the given persistent cache if they are stored there and stores all other burned images.
+func (d *Downloader) UsePersistentCache(p *PersistentCache) {
+	d.persistentCache = p
+}
+
+// mirrorURLs returns the url of the image followed by its urls on all mirrors.
+func mirrorURLs(image string, mirrors []string) ([]string, error) {
+	result := []string{image}
+	u, err := url.Parse(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image url %s %w", image, err)
+	}
+	for _, mirror := range mirrors {
+		m, err := url.Parse(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror url %s %w", mirror, err)
+		}
+		m.Path = path.Join("/", m.Path, u.Path)
+		m.RawQuery = u.RawQuery
+		if m.String() != image {
+			result = append(result, m.String())
+		}
+	}
+	return result, nil
+}
+
+// download is the content of a url which is read in one or more attempts, every attempt continues at the offset
+// where the previous attempt stopped.
+type download struct {
+	d      *Downloader
+	urls   []string
+	header http.Header
+	// notFound are the urls which do not provide the content
+	notFound map[string]bool
+	// unreachable are the urls whose last request failed
+	unreachable map[string]bool
+	current     int
+	// size of the content, -1 if unknown
+	size   int64
+	offset int64
+	// done is set once the content was read completely
+	done bool
+	// failures is the number of consecutive failed requests and attempts, it is only reset once bytes are received
+	failures int
+	err      error
+
+	attempt      int
+	attemptStart time.Time
+	attemptBytes int64
+	body         io.ReadCloser
+	cancel       context.CancelFunc
+	stall        *time.Timer
+}
+
+// open starts the download of source, the returned download resumes by itself until all attempts are exhausted.
+func (d *Downloader) open(source string) (*download, error) {
+	urls, err := mirrorURLs(source, d.mirrors)
+	if err != nil {
+		return nil, err
+	}
+	return d.openURLs(urls, nil)
+}
+
+// openURLs starts the download of the content which is provided by all urls, the given header is sent with every request.
+func (d *Downloader) openURLs(urls []string, header http.Header) (*download, error) {
+	dl := &download{d: d, urls: urls, header: header, notFound: make(map[string]bool), unreachable: make(map[string]bool), size: -1}
+	err := dl.connect()
+	if err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// Size returns the size of the content, -1 if the server did not send it.
+func (dl *download) Size() int64 {
+	return dl.size
+}
+
+func (dl *download) Read(p []byte) (int, error) {
+	if dl.done {
+		return 0, io.EOF
+	}
+	for {
+		if dl.body == nil {
+			err := dl.connect()
+			if err != nil {
+				return 0, err
+			}
+		}
+		dl.stall.Reset(dl.d.stallTimeout)
+		n, err := dl.body.Read(p)
+		dl.offset += int64(n)
+		dl.attemptBytes += int64(n)
+		if n > 0 {
+			dl.failures = 0
+		}
+		if errors.Is(err, io.EOF) && (dl.size < 0 || dl.offset >= dl.size) {
+			dl.finishAttempt(nil)
+			dl.done = true
+			return n, io.EOF
+		}
+		if err == nil {
+			return n, nil
+		}
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		dl.finishAttempt(err)
+		dl.failures++
+		dl.err = err
+		// a server which accepts requests without sending any content is treated like a failed request
+		if dl.attemptBytes == 0 {
+			dl.next()
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close aborts the running attempt.
+func (dl *download) Close() error {
+	if dl.body != nil {
+		dl.finishAttempt(nil)
+	}
+	return nil
+}
+
+// connect requests the content from the current offset, failed requests are retried with an increasing backoff
+// on the next url. Urls which do not provide the content are skipped. The download fails after downloadAttempts
+// consecutive failed requests or attempts which did not receive any bytes.
+func (dl *download) connect() error {
+	for {
+		// the content is missing if all urls which are reachable do not provide it, e.g. a checksum file
+		// which is only published with another algorithm while the url of the image is down
+		if len(dl.notFound) > 0 && len(dl.notFound)+len(dl.unreachable) == len(dl.urls) {
+			return notFoundError{url: dl.urls[0]}
+		}
+		if dl.failures >= downloadAttempts {
+			return fmt.Errorf("download of %s failed after %d attempts %w", dl.urls[0], downloadAttempts, dl.err)
+		}
+		if dl.failures > 0 {
+			backoff := dl.d.backoff << (dl.failures - 1)
+			if backoff > maxBackoff || backoff <= 0 {
+				backoff = maxBackoff
+			}
+			log.Warn("download failed", "attempt", dl.attempt, "retry in", backoff, "error", dl.err)
+			time.Sleep(backoff)
+		}
+		source := dl.urls[dl.current]
+		dl.attempt++
+		err := dl.request(source)
+		if err == nil {
+			delete(dl.unreachable, source)
+			return nil
+		}
+		if isNotFound(err) {
+			delete(dl.unreachable, source)
+			dl.notFound[source] = true
+			dl.next()
+			continue
+		}
+		dl.unreachable[source] = true
+		dl.next()
+		dl.failures++
+		dl.err = err
+	}
+}
+
+// next selects the next url which was not found to be missing.
+func (dl *download) next() {
+	for i := 0; i < len(dl.urls); i++ {
+		dl.current = (dl.current + 1) % len(dl.urls)
+		if !dl.notFound[dl.urls[dl.current]] {
+			return
+		}
+	}
+}
+
+func (dl *download) request(source string) error {
+	log.Info("download", "from", source, "attempt", dl.attempt, "offset", dl.offset)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+	for key, values := range dl.header {
+		req.Header[key] = values
+	}
+	if dl.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", dl.offset))
+	}
+	stall := time.AfterFunc(dl.d.stallTimeout, cancel)
+	resp, err := dl.d.client.Do(req)
+	if err != nil {
+		stall.Stop()
+		cancel()
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		stall.Stop()
+		cancel()
+		resp.Body.Close()
+		return statusError(source, resp)
+	}
+
+	body := resp.Body
+	switch {
+	case dl.offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		var start int64
+		_, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+		if err != nil || start != dl.offset {
+			stall.Stop()
+			cancel()
+			body.Close()
+			return fmt.Errorf("unexpected content range %q of %s", resp.Header.Get("Content-Range"), source)
+		}
+	case dl.offset > 0:
+		// the server does not support range requests, skip what was already read,
+		// the checksum of the image detects if the content differs from the previous attempts
+		log.Warn("download can not be resumed, skipping already downloaded bytes", "from", source, "offset", dl.offset)
+		_, err = io.CopyN(io.Discard, body, dl.offset)
+		if err != nil {
+			stall.Stop()
+			cancel()
+			body.Close()
+			return err
+		}
+	default:
+		dl.size = resp.ContentLength
+	}
+
+	dl.body = body
+	dl.cancel = cancel
+	dl.stall = stall
+	dl.attemptStart = time.Now()
+	dl.attemptBytes = 0
+	return nil
+}
+
+// finishAttempt closes the running attempt and reports its throughput.
+func (dl *download) finishAttempt(err error) {
+	dl.stall.Stop()
+	dl.cancel()
+	dl.body.Close()
+	dl.body = nil
+
+	duration := time.Since(dl.attemptStart)
+	throughput := float64(dl.attemptBytes) / duration.Seconds() / 1024 / 1024
+	if err != nil {
+		log.Warn("download interrupted", "from", dl.urls[dl.current], "attempt", dl.attempt, "bytes", dl.attemptBytes,
+			"duration", duration, "throughput", fmt.Sprintf("%.1fMiB/s", throughput), "error", err)
+		return
+	}
+	log.Info("download finished", "from", dl.urls[dl.current], "attempt", dl.attempt, "bytes", dl.attemptBytes,
+		"duration", duration, "throughput", fmt.Sprintf("%.1fMiB/s", throughput))
+}
+
+// notFoundError is returned by fetch if the url does not exist
+type notFoundError struct {
+	url string
+}
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("%s not found", e.url)
+}
+
+func isNotFound(err error) bool {
+	return errors.As(err, &notFoundError{})
+}
+
+// fetch returns the content of a small file like a checksum or signature from the given url.
+func (d *Downloader) fetch(source string) ([]byte, error) {
+	dl, err := d.open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer dl.Close()
+
+	content, err := io.ReadAll(io.LimitReader(dl, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s %w", source, err)
+	}
+	return content, nil
+}
+
+// statusError returns the error for an unsuccessful response.
+func statusError(source string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return notFoundError{url: source}
+	}
+	return fmt.Errorf("download of %s did not work, statuscode was: %d", source, resp.StatusCode)
+}
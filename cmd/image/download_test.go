@@ -0,0 +1,233 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		mirrors []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "no mirrors",
+			image: "http://images.metal-stack.io/metal-os/ubuntu/20.04/img.tar.lz4",
+			want:  []string{"http://images.metal-stack.io/metal-os/ubuntu/20.04/img.tar.lz4"},
+		},
+		{
+			name:    "mirrors with and without path",
+			image:   "http://images.metal-stack.io/metal-os/ubuntu/20.04/img.tar.lz4?v=1",
+			mirrors: []string{"https://mirror.local", "http://10.0.0.1:8080/cache/", "http://images.metal-stack.io"},
+			want: []string{
+				"http://images.metal-stack.io/metal-os/ubuntu/20.04/img.tar.lz4?v=1",
+				"https://mirror.local/metal-os/ubuntu/20.04/img.tar.lz4?v=1",
+				"http://10.0.0.1:8080/cache/metal-os/ubuntu/20.04/img.tar.lz4?v=1",
+			},
+		},
+		{
+			name:    "invalid mirror",
+			image:   "http://images.metal-stack.io/img.tar.lz4",
+			mirrors: []string{"http://[::1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mirrorURLs(tt.image, tt.mirrors)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mirrorURLs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mirrorURLs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testDownloader(t *testing.T, mirrors ...string) *Downloader {
+	d, err := NewDownloader(mirrors, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoff = time.Millisecond
+	d.stallTimeout = time.Second
+	return d
+}
+
+// interruptingHandler serves content with range support but aborts every response after chunk bytes
+func interruptingHandler(content []byte, chunk int, requests *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		rw := &limitedResponseWriter{ResponseWriter: w, limit: chunk}
+		http.ServeContent(rw, r, "img.tar", time.Time{}, bytes.NewReader(content))
+		if rw.limited {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	limit   int
+	limited bool
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		p = p[:w.limit]
+		w.limited = true
+	}
+	w.limit -= len(p)
+	n, err := w.ResponseWriter.Write(p)
+	if err == nil && w.limited {
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("metal-hammer"), 10000)
+	var requests int32
+	server := httptest.NewServer(interruptingHandler(content, 40000, &requests))
+	defer server.Close()
+
+	dl, err := testDownloader(t).open(server.URL + "/img.tar")
+	if err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	defer dl.Close()
+	got, err := io.ReadAll(dl)
+	if err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("download content differs, got %d bytes want %d bytes", len(got), len(content))
+	}
+	// reading a completed download must not request the content again
+	n, err := dl.Read(make([]byte, 1))
+	if n != 0 || !errors.Is(err, io.EOF) {
+		t.Errorf("read after end of download = %d %v, want EOF", n, err)
+	}
+	if requests != 3 {
+		t.Errorf("download took %d requests, want 3", requests)
+	}
+}
+
+func TestDownloadFailover(t *testing.T) {
+	content := []byte("metal-hammer")
+	var failed, missing int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failed, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&missing, 1)
+		http.NotFound(w, r)
+	}))
+	defer empty.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/img.tar" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer mirror.Close()
+
+	got, err := testDownloader(t, empty.URL, mirror.URL).fetchAll(broken.URL + "/images/img.tar")
+	if err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("download = %q, want %q", got, content)
+	}
+	if failed != 1 || missing != 1 {
+		t.Errorf("download requested broken server %d times and empty mirror %d times, want 1 and 1", failed, missing)
+	}
+
+	_, err = testDownloader(t, empty.URL).fetchAll(empty.URL + "/images/img.tar")
+	if !isNotFound(err) {
+		t.Errorf("download error = %v, want not found", err)
+	}
+
+	_, err = testDownloader(t).fetchAll(broken.URL + "/images/img.tar")
+	if err == nil || !strings.Contains(err.Error(), "failed after 10 attempts") {
+		t.Errorf("download error = %v, want failure after all attempts", err)
+	}
+}
+
+func TestDownloadChecksumFailover(t *testing.T) {
+	image := gzipped(t, testTar(t))
+	sha256sum := fmt.Sprintf("%x  img.tar.gz\n", sha256.Sum256(image))
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/img.tar.gz":
+			_, _ = w.Write(image)
+		case "/images/img.tar.gz.sha256":
+			_, _ = w.Write([]byte(sha256sum))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	d := testDownloader(t, mirror.URL)
+	layers, err := d.Burn(t.TempDir(), dead.URL+"/images/img.tar.gz", nil, Policy{})
+	if err != nil {
+		t.Fatalf("Burn() error = %v", err)
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256(image)); len(layers) != 1 || layers[0].Digest != want {
+		t.Errorf("Burn() layers = %v, want digest %s", layers, want)
+	}
+}
+
+func TestDownloadResetWithoutContent(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	_, err := testDownloader(t).fetchAll(server.URL + "/img.tar")
+	if err == nil || !strings.Contains(err.Error(), "failed after 10 attempts") {
+		t.Errorf("download error = %v, want failure after all attempts", err)
+	}
+	if requests != downloadAttempts {
+		t.Errorf("download took %d requests, want %d", requests, downloadAttempts)
+	}
+}
+
+func (d *Downloader) fetchAll(source string) ([]byte, error) {
+	dl, err := d.open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer dl.Close()
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(dl)
+	return buf.Bytes(), err
+}
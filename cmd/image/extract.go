@@ -0,0 +1,410 @@
+package image
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// xattrPrefix of pax records which contain extended attributes, e.g. security.capability or security.selinux
+	xattrPrefix = "SCHILY.xattr."
+	// aclAccess and aclDefault are the pax records of posix acls in the text form written by star and gnu tar
+	aclAccess  = "SCHILY.acl.access"
+	aclDefault = "SCHILY.acl.default"
+	// gnuSparsePrefix of pax records which describe the holes of a sparse file
+	gnuSparsePrefix = "GNU.sparse."
+	// sparseBlockSize is the granularity in which holes of sparse files are detected
+	sparseBlockSize = 4096
+	// maxSymlinks is the number of symlinks which are followed to resolve a path, like the kernel does
+	maxSymlinks = 40
+)
+
+// extractStats summarizes the entries which were extracted from a tar archive
+type extractStats struct {
+	files       int
+	directories int
+	symlinks    int
+	hardlinks   int
+	devices     int
+	bytes       int64
+	xattrs      int
+	// skippedXattrs are not supported by the filesystem the entry was extracted to, e.g. vfat
+	skippedXattrs int
+	// replaced are existing entries which were replaced by an entry of the archive
+	replaced int
+}
+
+// logContext returns the stats as key value pairs for log15.
+func (s *extractStats) logContext() []interface{} {
+	return []interface{}{
+		"files", s.files, "directories", s.directories, "symlinks", s.symlinks, "hardlinks", s.hardlinks,
+		"devices", s.devices, "bytes", s.bytes, "xattrs", s.xattrs, "skipped xattrs", s.skippedXattrs, "replaced", s.replaced,
+	}
+}
+
+// extractor writes the entries of tar archives below prefix with their ownership, modes, times and extended attributes.
+// Entries can not escape prefix, neither by their name nor through symlinks, which are resolved as if prefix was the root.
+type extractor struct {
+	prefix string
+	stats  extractStats
+	// dirs get their times set after all entries were written, which modifies the times of their parent directory
+	dirs []*tar.Header
+	// overlay is the url of the overlay which is extracted, entries which replace existing entries are logged
+	overlay string
+	// owners are the overlays which wrote the entries, they are shared by all overlays of an image
+	owners map[string]string
+}
+
+// extractTar extracts a tar archive into prefix.
+func extractTar(r io.Reader, prefix string) (*extractStats, error) {
+	e := &extractor{prefix: prefix}
+	return e.extractTar(r)
+}
+
+func (e *extractor) extractTar(r io.Reader) (*extractStats, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read archive %w", err)
+		}
+		name, err := entryName(hdr.Name)
+		if err == nil {
+			err = e.extract(tr, hdr, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to extract %s %w", hdr.Name, err)
+		}
+	}
+	err := e.finish()
+	if err != nil {
+		return nil, err
+	}
+	return &e.stats, nil
+}
+
+// entryName returns the clean absolute name of an entry relative to the prefix,
+// names which point outside of the prefix are rejected.
+func entryName(name string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(name, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("entry escapes the prefix")
+	}
+	return path.Join("/", clean), nil
+}
+
+// resolve returns the path of the absolute and clean name below the prefix. Symlinks in name are resolved
+// as if the prefix was the root directory, the last component is only resolved if follow is set.
+func (e *extractor) resolve(name string, follow bool) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	links := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, component)
+		if len(remaining) == 0 && !follow {
+			resolved = next
+			break
+		}
+		info, err := os.Lstat(filepath.Join(e.prefix, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// missing components are created as directories
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(e.prefix, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return filepath.Join(e.prefix, resolved), nil
+}
+
+// extract writes a single entry, an existing file is replaced, an existing directory is kept.
+func (e *extractor) extract(tr *tar.Reader, hdr *tar.Header, name string) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+	target, err := e.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	existing, err := os.Lstat(target)
+	if err == nil && !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		e.replace(name, target)
+		err = os.RemoveAll(target)
+		if err != nil {
+			return err
+		}
+	}
+	if e.owners != nil {
+		e.owners[target] = e.overlay
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = os.MkdirAll(target, 0700)
+		e.stats.directories++
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if isSparse(hdr) {
+			err = writeSparseFile(tr, target, mode.Perm(), hdr.Size)
+		} else {
+			err = writeFile(tr, target, mode.Perm())
+		}
+		e.stats.files++
+		e.stats.bytes += hdr.Size
+	case tar.TypeSymlink:
+		err = os.Symlink(hdr.Linkname, target)
+		e.stats.symlinks++
+	case tar.TypeLink:
+		return e.link(hdr, target)
+	case tar.TypeChar:
+		err = unix.Mknod(target, unix.S_IFCHR|uint32(mode.Perm()), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		e.stats.devices++
+	case tar.TypeBlock:
+		err = unix.Mknod(target, unix.S_IFBLK|uint32(mode.Perm()), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		e.stats.devices++
+	case tar.TypeFifo:
+		err = unix.Mkfifo(target, uint32(mode.Perm()))
+		e.stats.devices++
+	default:
+		return fmt.Errorf("unsupported type %q", hdr.Typeflag)
+	}
+	if err != nil {
+		return err
+	}
+	return e.setMetadata(target, hdr)
+}
+
+// replace counts an existing entry which is replaced, conflicts of overlays are logged with the layer of the replaced entry.
+func (e *extractor) replace(name, target string) {
+	e.stats.replaced++
+	if e.overlay == "" {
+		return
+	}
+	owner, ok := e.owners[target]
+	if !ok {
+		owner = "image"
+	}
+	log.Info("overlay replaces entry", "entry", name, "overlay", e.overlay, "replaced from", owner)
+}
+
+// link creates a hardlink to a previously extracted entry, which shares the metadata of the entry.
+func (e *extractor) link(hdr *tar.Header, target string) error {
+	name, err := entryName(hdr.Linkname)
+	if err != nil {
+		return fmt.Errorf("link target %s %w", hdr.Linkname, err)
+	}
+	source, err := e.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	err = os.Link(source, target)
+	if err != nil {
+		return err
+	}
+	e.stats.hardlinks++
+	return nil
+}
+
+// setMetadata sets ownership, mode, extended attributes and times of an extracted entry.
+func (e *extractor) setMetadata(target string, hdr *tar.Header) error {
+	err := os.Lchown(target, hdr.Uid, hdr.Gid)
+	if err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		// chown clears setuid and setgid bits, the mode must be set afterwards
+		mode := hdr.FileInfo().Mode()
+		err = os.Chmod(target, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return err
+		}
+	}
+	// file capabilities in security.capability are cleared by chown as well
+	err = e.setXattrs(target, hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		e.dirs = append(e.dirs, hdr)
+		return nil
+	}
+	return setTimes(target, hdr)
+}
+
+// setXattrs sets the extended attributes and posix acls of the entry.
+func (e *extractor) setXattrs(target string, hdr *tar.Header) error {
+	xattrs := make(map[string][]byte)
+	for key, value := range hdr.PAXRecords {
+		switch {
+		case strings.HasPrefix(key, xattrPrefix):
+			xattrs[strings.TrimPrefix(key, xattrPrefix)] = []byte(value)
+		case key == aclAccess || key == aclDefault:
+			acl, err := aclXattr(value)
+			if err != nil {
+				return fmt.Errorf("invalid acl %s %w", key, err)
+			}
+			if acl == nil {
+				continue
+			}
+			if key == aclAccess {
+				xattrs[xattrACLAccess] = acl
+			} else {
+				xattrs[xattrACLDefault] = acl
+			}
+		}
+	}
+	for name, value := range xattrs {
+		err := unix.Lsetxattr(target, name, value, 0)
+		if errors.Is(err, unix.ENOTSUP) {
+			log.Debug("extended attribute not supported", "path", target, "name", name)
+			e.stats.skippedXattrs++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to set extended attribute %s %w", name, err)
+		}
+		e.stats.xattrs++
+	}
+	return nil
+}
+
+// finish sets the times of all extracted directories, children first.
+func (e *extractor) finish() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		hdr := e.dirs[i]
+		name, err := entryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		target, err := e.resolve(name, false)
+		if err != nil {
+			return err
+		}
+		err = setTimes(target, hdr)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to set times of %s %w", hdr.Name, err)
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+// setTimes sets access and modification time of the entry, symlinks are not followed.
+func setTimes(target string, hdr *tar.Header) error {
+	accessTime := hdr.AccessTime
+	if accessTime.IsZero() {
+		accessTime = hdr.ModTime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(accessTime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// writeFile writes the content of a regular file.
+func writeFile(r io.Reader, target string, perm os.FileMode) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSparseFile writes the content of a sparse file of size bytes, the tar reader returns the holes as zeros,
+// all-zero blocks are skipped to keep them as holes.
+func writeSparseFile(r io.Reader, target string, perm os.FileMode, size int64) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sparseBlockSize)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				_, err = f.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = f.Write(buf[:n])
+			}
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if errors.Is(rerr, io.EOF) || errors.Is(rerr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if rerr != nil {
+			f.Close()
+			return rerr
+		}
+	}
+	// a trailing hole is not written at all
+	err = f.Truncate(size)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// isSparse returns true for gnu sparse files in the old gnu format and in the pax format.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, gnuSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type testEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func testArchive(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		hdr.Uid = os.Getuid()
+		hdr.Gid = os.Getgid()
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = time.Unix(1666000000, 0)
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		err := tw.WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(e.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	archive := testArchive(t, []testEntry{
+		{hdr: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Unix(1600000000, 0)}},
+		{
+			hdr: tar.Header{
+				Name: "usr/bin/ping", Typeflag: tar.TypeReg, Mode: 04755,
+				PAXRecords: map[string]string{"SCHILY.xattr.user.metal": "hammer"},
+			},
+			content: "#!",
+		},
+		{hdr: tar.Header{Name: "usr/bin/ping6", Typeflag: tar.TypeLink, Linkname: "usr/bin/ping"}},
+		{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"}},
+		{hdr: tar.Header{Name: "run/initctl", Typeflag: tar.TypeFifo, Mode: 0600}},
+		{hdr: tar.Header{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755}, content: "sh"},
+	})
+
+	prefix := t.TempDir()
+	stats, err := extractTar(bytes.NewReader(archive), prefix)
+	if err != nil {
+		t.Fatalf("extractTar() error = %v", err)
+	}
+	want := extractStats{files: 2, directories: 2, symlinks: 1, hardlinks: 1, devices: 1, bytes: 4}
+	// the filesystem of the test directory might not support user extended attributes
+	want.xattrs, want.skippedXattrs = stats.xattrs, stats.skippedXattrs
+	if !reflect.DeepEqual(*stats, want) || stats.xattrs+stats.skippedXattrs != 1 {
+		t.Errorf("extractTar() stats = %+v, want %+v", *stats, want)
+	}
+
+	ping, err := os.Stat(filepath.Join(prefix, "usr", "bin", "ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping.Mode() != 0755|os.ModeSetuid {
+		t.Errorf("usr/bin/ping mode = %v, want setuid 0755", ping.Mode())
+	}
+	ping6, err := os.Stat(filepath.Join(prefix, "usr", "bin", "ping6"))
+	if err != nil || !os.SameFile(ping, ping6) {
+		t.Errorf("usr/bin/ping6 is not a hardlink of usr/bin/ping %v", err)
+	}
+	if stats.xattrs == 1 {
+		value := make([]byte, 64)
+		n, err := unix.Lgetxattr(filepath.Join(prefix, "usr", "bin", "ping"), "user.metal", value)
+		if err != nil || string(value[:n]) != "hammer" {
+			t.Errorf("usr/bin/ping xattr user.metal = %q %v, want hammer", value[:n], err)
+		}
+	}
+	// bin/sh is written through the bin symlink
+	content, err := os.ReadFile(filepath.Join(prefix, "usr", "bin", "sh"))
+	if err != nil || string(content) != "sh" {
+		t.Errorf("usr/bin/sh = %q %v, want sh", content, err)
+	}
+	fifo, err := os.Lstat(filepath.Join(prefix, "run", "initctl"))
+	if err != nil || fifo.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("run/initctl is not a fifo %v", err)
+	}
+	// the times of directories are set after their content was written
+	dir, err := os.Stat(filepath.Join(prefix, "usr", "bin"))
+	if err != nil || !dir.ModTime().Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("usr/bin modification time = %v %v, want %v", dir.ModTime(), err, time.Unix(1600000000, 0))
+	}
+}
+
+func TestExtractTarEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		wantErr string
+	}{
+		{
+			name:    "parent directory",
+			entries: []testEntry{{hdr: tar.Header{Name: "../escaped", Typeflag: tar.TypeReg}, content: "evil"}},
+			wantErr: "escapes the prefix",
+		},
+		{
+			name:    "parent directory after clean",
+			entries: []testEntry{{hdr: tar.Header{Name: "etc/../../escaped", Typeflag: tar.TypeReg}, content: "evil"}},
+			wantErr: "escapes the prefix",
+		},
+		{
+			name:    "hardlink to parent directory",
+			entries: []testEntry{{hdr: tar.Header{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: "../escaped"}}},
+			wantErr: "escapes the prefix",
+		},
+		{
+			name: "absolute symlink",
+			entries: []testEntry{
+				{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/"}},
+				{hdr: tar.Header{Name: "etc/escaped", Typeflag: tar.TypeReg}, content: "contained"},
+			},
+		},
+		{
+			name: "relative symlink",
+			entries: []testEntry{
+				{hdr: tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "../../.."}},
+				{hdr: tar.Header{Name: "lib/escaped", Typeflag: tar.TypeReg}, content: "contained"},
+			},
+		},
+		{
+			name: "symlink loop",
+			entries: []testEntry{
+				{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"}},
+				{hdr: tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"}},
+				{hdr: tar.Header{Name: "a/escaped", Typeflag: tar.TypeReg}, content: "evil"},
+			},
+			wantErr: "too many levels of symbolic links",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			prefix := filepath.Join(parent, "root")
+			err := os.Mkdir(prefix, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = extractTar(bytes.NewReader(testArchive(t, tt.entries)), prefix)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("extractTar() error = %v, want %s", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("extractTar() error = %v", err)
+			}
+
+			if _, err := os.Lstat(filepath.Join(parent, "escaped")); !os.IsNotExist(err) {
+				t.Errorf("entry escaped the prefix")
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			content, err := os.ReadFile(filepath.Join(prefix, "escaped"))
+			if err != nil || string(content) != "contained" {
+				t.Errorf("escaped = %q %v, want contained within the prefix", content, err)
+			}
+		})
+	}
+}
+
+func TestACLXattr(t *testing.T) {
+	got, err := aclXattr("user::rwx,user:jane:r-x:1000,group::r-x,mask::r-x,other::---,group:100:rw-")
+	if err != nil {
+		t.Fatalf("aclXattr() error = %v", err)
+	}
+	want := []byte{
+		2, 0, 0, 0,
+		0x01, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0, 5, 0, 0xe8, 0x03, 0, 0,
+		0x04, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+		0x08, 0, 6, 0, 100, 0, 0, 0,
+		0x10, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+		0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("aclXattr() = %v, want %v", got, want)
+	}
+
+	got, err = aclXattr("user::rw-\ngroup::r--\t#effective:r--\nother::r--\n")
+	if err != nil || len(got) != 4+3*8 {
+		t.Errorf("aclXattr() = %v %v, want three entries", got, err)
+	}
+	got, err = aclXattr("")
+	if err != nil || got != nil {
+		t.Errorf("aclXattr() = %v %v, want no acl", got, err)
+	}
+	for _, invalid := range []string{"user:jane:rwx", "user::rwxx", "owner::rwx", "user::w"} {
+		_, err = aclXattr(invalid)
+		if err == nil {
+			t.Errorf("aclXattr(%q) expected error", invalid)
+		}
+	}
+}
+
+// sparseArchive returns a tar archive in the old gnu sparse format with a file of size bytes,
+// which contains data only at the given offsets.
+func sparseArchive(t *testing.T, name string, size int64, data map[int64]string) []byte {
+	offsets := []int64{}
+	stored := ""
+	for offset := range data {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	if len(offsets) > 4 {
+		t.Fatalf("the header contains at most 4 sparse entries")
+	}
+	for _, offset := range offsets {
+		stored += data[offset]
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(stored)), Format: tar.FormatGNU})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tw.Write([]byte(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the go tar writer does not create sparse files, the header is converted afterwards
+	archive := buf.Bytes()
+	hdr := archive[:512]
+	hdr[156] = tar.TypeGNUSparse
+	for i, offset := range offsets {
+		copy(hdr[386+i*24:], fmt.Sprintf("%011o\x00%011o\x00", offset, len(data[offset])))
+	}
+	copy(hdr[483:], fmt.Sprintf("%011o\x00", size))
+	copy(hdr[148:], "        ")
+	sum := 0
+	for _, b := range hdr {
+		sum += int(b)
+	}
+	copy(hdr[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return archive
+}
+
+func TestExtractSparse(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	data := map[int64]string{0: "metal", 32 * 1024 * 1024: "hammer"}
+	archive := sparseArchive(t, "var/lib/sparse.img", size, data)
+
+	prefix := t.TempDir()
+	_, err := extractTar(bytes.NewReader(archive), prefix)
+	if err != nil {
+		t.Fatalf("extractTar() error = %v", err)
+	}
+	file := filepath.Join(prefix, "var", "lib", "sparse.img")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != size {
+		t.Fatalf("sparse file has %d bytes, want %d", len(content), size)
+	}
+	for offset, want := range data {
+		if got := string(content[offset : offset+int64(len(want))]); got != want {
+			t.Errorf("content at %d = %q, want %q", offset, got, want)
+		}
+	}
+	var st unix.Stat_t
+	err = unix.Stat(file, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// st_blocks counts 512 byte blocks, only the two blocks with data must be allocated
+	if allocated := st.Blocks * 512; allocated > 1024*1024 {
+		t.Errorf("sparse file allocates %d bytes, want the holes to be kept", allocated)
+	}
+}
@@ -5,161 +5,163 @@ import (
 
 	pb "github.com/cheggaaa/pb/v3"
 	log "github.com/inconshreveable/log15"
-	"github.com/mholt/archiver"
-	lz4 "github.com/pierrec/lz4/v4"
 
-	//nolint:gosec
-	"crypto/md5"
 	"io"
-	"net/http"
 	"os"
-	"strings"
 	"time"
 )
 
-// Pull a image from s3
-func Pull(image, destination string) error {
-	log.Info("pull image", "image", image)
-	md5destination := destination + ".md5"
-	md5file := image + ".md5"
-	err := download(image, destination)
+// Layer is the image, a layer of an oci image or an overlay which was burned
+type Layer struct {
+	URL string
+	// Digest of the verified content in the form algorithm:hex
+	Digest string
+}
+
+// Burn streams the image from the given url through decompression and tar extraction into prefix,
+// no temporary copy of the image is written. The image is hashed while it is extracted and
+// burning fails if the checksum does not match the one which is published next to the image,
+// the checksum file itself is verified according to the given policy before the image is pulled.
+// Images in oci registries are referenced with oci://registry/repository:tag@digest and verified by their digests.
+// The overlays are extracted on top of the image afterwards, see BurnOverlays.
+// The digests of the image, or of all layers of an oci image, and of the overlays are returned.
+func (d *Downloader) Burn(prefix, image string, overlays []string, policy Policy) ([]Layer, error) {
+	layers, err := d.burnImage(prefix, image, policy)
 	if err != nil {
-		return fmt.Errorf("unable to pull image %s %w", image, err)
+		return nil, err
 	}
-	err = download(md5file, md5destination)
-	defer os.Remove(md5destination)
+	overlayLayers, err := d.BurnOverlays(prefix, overlays, policy)
 	if err != nil {
-		return fmt.Errorf("unable to pull md5 %s %w", md5file, err)
-	}
-	log.Info("check md5")
-	matches, err := checkMD5(destination, md5destination)
-	if err != nil || !matches {
-		return fmt.Errorf("md5sum mismatch")
+		return nil, err
 	}
-
-	log.Info("pull image done", "image", image)
-	return nil
+	return append(layers, overlayLayers...), nil
 }
 
-// Burn a image pulling a tarball and unpack to a specific directory
-func Burn(prefix, image, source string) error {
+func (d *Downloader) burnImage(prefix, image string, policy Policy) ([]Layer, error) {
+	if IsOCI(image) {
+		return d.burnOCI(prefix, image, policy)
+	}
 	log.Info("burn image", "image", image)
-	begin := time.Now()
-
-	file, err := os.Open(source)
+	sum, err := d.burn(image, policy, decompress, func(r io.Reader) error {
+		stats, err := extractTar(r, prefix)
+		if err != nil {
+			return err
+		}
+		log.Info("image extracted", stats.logContext()...)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("%s: failed to open archive %w", source, err)
-
+		return nil, err
 	}
-	defer file.Close()
+	return []Layer{{URL: image, Digest: sum.digest()}}, nil
+}
 
-	stat, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("unable to stat %s %w", source, err)
-	}
+// burn streams the image through decompression into write and verifies its checksum, the verified checksum is returned.
+func (d *Downloader) burn(image string, policy Policy, decompress func(io.Reader) (io.ReadCloser, compression, error), write func(io.Reader) error) (*checksum, error) {
+	begin := time.Now()
 
-	if !strings.HasSuffix(image, "lz4") {
-		return fmt.Errorf("unsupported image compression format of image:%s", image)
+	dl, sum, err := d.openImage(image, policy)
+	if err != nil {
+		return nil, err
 	}
+	defer dl.Close()
 
-	lz4Reader := lz4.NewReader(file)
-	log.Info("lz4", "size", lz4Reader.Size())
-	creader := io.NopCloser(lz4Reader)
-	// wild guess for lz4 compression ratio
-	// lz4 is a stream format and therefore the
-	// final size cannot be calculated upfront
-	csize := stat.Size() * 2
-	defer creader.Close()
-
-	bar := pb.New64(csize)
+	// the uncompressed size of stream formats cannot be calculated upfront,
+	// therefore the progress is shown for the compressed image
+	bar := pb.New64(dl.Size())
 	bar.Set(pb.Bytes, true)
 	bar.Start()
 	bar.SetWidth(80)
 
-	reader := bar.NewProxyReader(creader)
-
-	err = archiver.Tar.Read(reader, prefix)
-	if err != nil {
-		return fmt.Errorf("unable to burn image %s %w", source, err)
+	h := sum.algorithm.hash()
+	var w io.Writer = h
+	cw := d.persistentCache.create(sum, dl.Size())
+	defer cw.discard()
+	if cw != nil {
+		w = io.MultiWriter(h, cw)
 	}
+	body := io.TeeReader(bar.NewProxyReader(dl), w)
 
-	bar.Finish()
-
-	err = os.Remove(source)
+	reader, compression, err := decompress(body)
 	if err != nil {
-		log.Warn("burn image unable to remove image source", "error", err)
+		return nil, fmt.Errorf("unable to burn image %s %w", image, err)
 	}
+	defer reader.Close()
+	log.Info("burn image", "compression", compression)
 
-	log.Info("burn took", "duration", time.Since(begin))
-	return nil
-}
-
-// checkMD5 check the md5 signature of file with the md5sum given in the md5file.
-// the content of the md5file must be in the form:
-// <md5sum> filename
-// this is the same format as create by the "md5sum" unix command
-func checkMD5(file, md5file string) (bool, error) {
-	md5fileContent, err := os.ReadFile(md5file)
+	err = write(reader)
 	if err != nil {
-		return false, fmt.Errorf("unable to read md5sum file %s %w", md5file, err)
+		return nil, fmt.Errorf("unable to burn image %s %w", image, err)
 	}
-	expectedMD5 := strings.Split(string(md5fileContent), " ")[0]
-
-	f, err := os.Open(file)
+	// the checksum covers the whole image, including trailing bytes which were not required to extract it
+	_, err = io.Copy(io.Discard, body)
 	if err != nil {
-		return false, fmt.Errorf("unable to read file: %s %w", file, err)
+		return nil, fmt.Errorf("unable to pull image %s %w", image, err)
 	}
-	defer f.Close()
+	bar.Finish()
 
-	//nolint:gosec
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return false, fmt.Errorf("unable to calculate md5sum of file: %s %w", file, err)
-	}
-	sourceMD5 := fmt.Sprintf("%x", h.Sum(nil))
-	log.Info("check md5", "source md5", sourceMD5, "expected md5", expectedMD5)
-	if sourceMD5 != expectedMD5 {
-		return false, fmt.Errorf("source md5:%s expected md5:%s", sourceMD5, expectedMD5)
+	sourceSum := fmt.Sprintf("%x", h.Sum(nil))
+	log.Info("check checksum", "algorithm", sum.algorithm.name, "source", sourceSum, "expected", sum.sum)
+	if sourceSum != sum.sum {
+		return nil, fmt.Errorf("%s mismatch of image %s, source:%s expected:%s", sum.algorithm.name, image, sourceSum, sum.sum)
 	}
-	return true, nil
+	cw.commit()
+
+	log.Info("burn took", "duration", time.Since(begin))
+	return sum, nil
 }
 
-// downloadFile will download from a source url to a local file dest.
-// It's efficient because it will write as it downloads
-// and not load the whole file into memory.
-func download(source, dest string) error {
-	log.Info("download", "from", source, "to", dest)
-	out, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf("unable to create destination %s %w", dest, err)
-	}
-	defer out.Close()
+// imageSource is either the download of an image or its cached copy
+type imageSource interface {
+	io.ReadCloser
+	Size() int64
+}
 
-	// Get the data
-	//nolint:gosec,noctx
-	resp, err := http.Get(source)
+// openImage fetches and verifies the checksum of the image and opens the prefetched copy of the image if it matches
+// the checksum, otherwise the image is opened from the persistent cache or downloaded.
+func (d *Downloader) openImage(image string, policy Policy) (imageSource, *checksum, error) {
+	sum, err := d.fetchChecksum(image, policy)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("unable to verify image %s %w", image, err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= http.StatusBadRequest {
-		return fmt.Errorf("download of %s did not work, statuscode was: %d", source, resp.StatusCode)
+	if cached := d.openCached(image, sum); cached != nil {
+		return cached, sum, nil
 	}
-
-	fileSize := resp.ContentLength
-
-	bar := pb.New64(fileSize)
-	bar.Set(pb.Bytes, true)
-	bar.SetWidth(80)
-	bar.Start()
-	defer bar.Finish()
-
-	reader := bar.NewProxyReader(resp.Body)
-	// Write the body to file
-	_, err = io.Copy(out, reader)
+	if cached := d.persistentCache.open(sum); cached != nil {
+		log.Info("burn image from persistent cache", "image", image, "file", cached.Name())
+		return cached, sum, nil
+	}
+	dl, err := d.open(image)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("unable to pull image %s %w", image, err)
 	}
+	return dl, sum, nil
+}
 
-	return nil
+// openCached opens the prefetched copy of the image if it matches the checksum, the result is reported
+// for the image which is installed.
+func (d *Downloader) openCached(image string, sum *checksum) imageSource {
+	if d.cache == nil {
+		return nil
+	}
+	var source imageSource
+	entry := d.cache.lookup(image)
+	switch {
+	case entry == nil:
+	case entry.checksum.algorithm.name != sum.algorithm.name || entry.checksum.sum != sum.sum:
+		// the image may have been replaced after it was prefetched
+		log.Warn("cached image does not match its checksum, pull it", "image", image, "cached", entry.checksum.sum, "expected", sum.sum)
+	default:
+		f, err := os.Open(entry.file)
+		if err != nil {
+			log.Warn("unable to open cached image, pull it", "image", image, "error", err)
+			break
+		}
+		log.Info("burn cached image", "image", image, "file", entry.file)
+		source = &cachedImage{File: f, size: entry.size}
+	}
+	if d.cacheReport != nil && d.cache.installs(image) {
+		d.cacheReport(image, source != nil)
+	}
+	return source
 }
@@ -1,44 +1,162 @@
 package image
 
 import (
+	"bytes"
+	"compress/gzip"
+	//nolint:gosec
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-func TestCheckMD5(t *testing.T) {
-	testfile := "/tmp/testmd5"
-	testfileMD5 := "/tmp/testmd5.md5"
-	content := []byte("This is testcontent")
-	err := os.WriteFile(testfile, content, os.ModePerm)
+func TestBurn(t *testing.T) {
+	var image bytes.Buffer
+	w := gzip.NewWriter(&image)
+	_, err := w.Write(testTar(t))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-
-	cmd := exec.Command("md5sum", testfile)
-	md5Content, err := cmd.Output()
-	if err != nil {
-		t.Error(err)
-	}
-	md5, err := os.Create(testfileMD5)
-	if err != nil {
-		t.Error(err)
-	}
-	_, err = md5.Write(md5Content)
+	err = w.Close()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	md5.Close()
 
-	defer os.Remove(testfile)
-	defer os.Remove(testfileMD5)
+	key, priv := testKey(t, 1)
+	sha256sum := fmt.Sprintf("%x  img.tar.gz\n", sha256.Sum256(image.Bytes()))
+	otherSum := fmt.Sprintf("%x  old.tar.gz\n", sha256.Sum256(image.Bytes()))
+	unnamedSum := fmt.Sprintf("%x\n", sha256.Sum256(image.Bytes()))
 
-	matches, err := checkMD5(testfile, testfileMD5)
-	if err != nil {
-		t.Error(err)
-	}
-	if !matches {
-		t.Error("expected md5 matches, but didn't")
+	tests := []struct {
+		name     string
+		checksum map[string]string
+		policy   Policy
+		wantErr  string
+	}{
+		{
+			name:     "md5sum matches",
+			checksum: map[string]string{".md5": fmt.Sprintf("%x  img.tar.gz\n", md5.Sum(image.Bytes()))}, //nolint:gosec
+		},
+		{
+			name:     "md5sum mismatch",
+			checksum: map[string]string{".md5": "d41d8cd98f00b204e9800998ecf8427e  img.tar.gz\n"},
+			wantErr:  "md5 mismatch",
+		},
+		{
+			name: "sha256 is preferred",
+			checksum: map[string]string{
+				".md5":    "d41d8cd98f00b204e9800998ecf8427e  img.tar.gz\n",
+				".sha256": fmt.Sprintf("%x  img.tar.gz\n", sha256.Sum256(image.Bytes())),
+			},
+		},
+		{
+			name:     "sha512 mismatch",
+			checksum: map[string]string{".sha512": fmt.Sprintf("%x  img.tar.gz\n", sha512.Sum512([]byte("other")))},
+			wantErr:  "sha512 mismatch",
+		},
+		{
+			name:    "checksum missing",
+			wantErr: "no checksum file",
+		},
+		{
+			name: "signed",
+			checksum: map[string]string{
+				".sha256":         sha256sum,
+				".sha256.minisig": string(minisign(key, priv, []byte(sha256sum), true, "timestamp:1666000000")),
+			},
+			policy: Policy{Keys: []PublicKey{key}, RequireSignature: true},
+		},
+		{
+			name:     "signature missing",
+			checksum: map[string]string{".sha256": sha256sum},
+			policy:   Policy{Keys: []PublicKey{key}, RequireSignature: true},
+			wantErr:  "unable to pull signature",
+		},
+		{
+			name:     "unsigned image is accepted if signatures are optional",
+			checksum: map[string]string{".sha256": sha256sum},
+			policy:   Policy{Keys: []PublicKey{key}},
+		},
+		{
+			name: "signed checksum of another image",
+			checksum: map[string]string{
+				".sha256":         otherSum,
+				".sha256.minisig": string(minisign(key, priv, []byte(otherSum), true, "timestamp:1666000000")),
+			},
+			policy:  Policy{Keys: []PublicKey{key}, RequireSignature: true},
+			wantErr: "not for image img.tar.gz",
+		},
+		{
+			name: "signed checksum without name",
+			checksum: map[string]string{
+				".sha256":         unnamedSum,
+				".sha256.minisig": string(minisign(key, priv, []byte(unnamedSum), true, "timestamp:1666000000")),
+			},
+			policy:  Policy{Keys: []PublicKey{key}, RequireSignature: true},
+			wantErr: "not for image img.tar.gz",
+		},
+		{
+			name:     "name is not checked if signatures are optional",
+			checksum: map[string]string{".sha256": otherSum},
+		},
+		{
+			name:     "md5 is refused if signatures are required",
+			checksum: map[string]string{".md5": fmt.Sprintf("%x  img.tar.gz\n", md5.Sum(image.Bytes()))}, //nolint:gosec
+			policy:   Policy{Keys: []PublicKey{key}, RequireSignature: true},
+			wantErr:  "not sufficient",
+		},
+		{
+			name:     "signature required",
+			checksum: map[string]string{".sha256": fmt.Sprintf("%x  img.tar.gz\n", sha256.Sum256(image.Bytes()))},
+			policy:   Policy{RequireSignature: true},
+			wantErr:  "no trusted keys",
+		},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/img.tar.gz":
+					_, _ = w.Write(image.Bytes())
+				default:
+					checksum, ok := tt.checksum[strings.TrimPrefix(r.URL.Path, "/img.tar.gz")]
+					if !ok {
+						http.NotFound(w, r)
+						return
+					}
+					_, _ = w.Write([]byte(checksum))
+				}
+			}))
+			defer server.Close()
 
+			prefix := t.TempDir()
+			d, err := NewDownloader(nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = d.Burn(prefix, server.URL+"/img.tar.gz", nil, tt.policy)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Burn() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Burn() error = %v", err)
+			}
+			content, err := os.ReadFile(filepath.Join(prefix, "etc", "hostname"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "metal-hammer" {
+				t.Errorf("Burn() extracted %q, want %q", string(content), "metal-hammer")
+			}
+		})
+	}
 }
@@ -0,0 +1,104 @@
+package image
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix marks a file which is deleted by a layer, see
+	// https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose content of lower layers is hidden
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// extractLayer applies a tar layer of an oci image on top of the content of prefix,
+// whiteouts remove the files of lower layers.
+func extractLayer(r io.Reader, prefix string) (*extractStats, error) {
+	e := &extractor{prefix: prefix}
+	tr := tar.NewReader(r)
+	// entries of this layer, opaque whiteouts only hide the content of lower layers
+	applied := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read layer %w", err)
+		}
+
+		name, err := entryName(hdr.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to extract %s %w", hdr.Name, err)
+		}
+		dir, base := path.Split(name)
+		switch {
+		case base == whiteoutOpaque:
+			err = e.removeLowerEntries(dir, applied)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			err = e.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		default:
+			err = e.extract(tr, hdr, name)
+			applied[name] = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to extract %s %w", hdr.Name, err)
+		}
+	}
+	err := e.finish()
+	if err != nil {
+		return nil, err
+	}
+	return &e.stats, nil
+}
+
+// remove deletes the entry of a lower layer.
+func (e *extractor) remove(name string) error {
+	target, err := e.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(target)
+}
+
+// removeLowerEntries removes all entries below dir which were not written by the current layer,
+// directories of the current layer are kept but the entries of lower layers inside them are removed as well.
+func (e *extractor) removeLowerEntries(dir string, applied map[string]bool) error {
+	target, err := e.resolve(dir, true)
+	if err != nil {
+		return err
+	}
+	return removeUnapplied(dir, target, applied)
+}
+
+func removeUnapplied(dir, target string, applied map[string]bool) error {
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		file := filepath.Join(target, entry.Name())
+		if !applied[name] {
+			err = os.RemoveAll(file)
+		} else if entry.IsDir() {
+			// symlinks are not followed, they are never reported as directory
+			err = removeUnapplied(name, file, applied)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
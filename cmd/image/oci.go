@@ -0,0 +1,424 @@
+package image
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	pb "github.com/cheggaaa/pb/v3"
+	log "github.com/inconshreveable/log15"
+)
+
+// ociScheme is the prefix of image urls which reference an image in an oci registry
+const ociScheme = "oci://"
+
+const (
+	mediaTypeOCIIndex            = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest         = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest      = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCILayer            = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip        = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayerZstd        = "application/vnd.oci.image.layer.v1.tar+zstd"
+	mediaTypeDockerLayer         = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeOCINondistributable = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+)
+
+// maxManifestSize protects against manifests which do not fit into memory
+const maxManifestSize = 4 * 1024 * 1024
+
+// ociReference is a parsed image url in the form oci://registry/repository:tag@digest
+type ociReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// IsOCI returns true if the image url references an image in an oci registry.
+func IsOCI(image string) bool {
+	return strings.HasPrefix(image, ociScheme)
+}
+
+func parseOCIReference(image string) (*ociReference, error) {
+	if !IsOCI(image) {
+		return nil, fmt.Errorf("%s is not an oci image reference", image)
+	}
+	rest := strings.TrimPrefix(image, ociScheme)
+	ref := &ociReference{tag: "latest"}
+	if i := strings.Index(rest, "@"); i >= 0 {
+		ref.digest = rest[i+1:]
+		rest = rest[:i]
+		if _, _, err := digestHash(ref.digest); err != nil {
+			return nil, err
+		}
+	}
+	i := strings.Index(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return nil, fmt.Errorf("oci image reference %s must contain a registry and a repository", image)
+	}
+	ref.registry = rest[:i]
+	ref.repository = rest[i+1:]
+	if j := strings.LastIndex(ref.repository, ":"); j >= 0 {
+		ref.tag = ref.repository[j+1:]
+		ref.repository = ref.repository[:j]
+		if ref.tag == "" || ref.repository == "" {
+			return nil, fmt.Errorf("invalid oci image reference %s", image)
+		}
+	}
+	return ref, nil
+}
+
+func (r *ociReference) String() string {
+	s := ociScheme + r.registry + "/" + r.repository + ":" + r.tag
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
+}
+
+// ociDescriptor references a manifest or blob by its digest
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociManifest is either an image index or an image manifest, docker manifest lists and manifests have the same structure
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// digestHash returns the hash and the expected hex encoded sum of the given digest, e.g. sha256:4f1a...
+func digestHash(digest string) (hash.Hash, string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, "", fmt.Errorf("invalid digest %q", digest)
+	}
+	switch parts[0] {
+	case "sha256":
+		return sha256.New(), parts[1], nil
+	case "sha512":
+		return sha512.New(), parts[1], nil
+	}
+	return nil, "", fmt.Errorf("unsupported digest algorithm of %q", digest)
+}
+
+func verifyDigest(digest string, content []byte) error {
+	h, expected, err := digestHash(digest)
+	if err != nil {
+		return err
+	}
+	_, _ = h.Write(content)
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	if sum != expected {
+		return fmt.Errorf("digest mismatch, got %s expected %s", sum, digest)
+	}
+	return nil
+}
+
+// registry is a client of the oci distribution api of one repository
+type registry struct {
+	d *Downloader
+	// base is the url of the api, e.g. https://registry/v2/
+	base  string
+	ref   *ociReference
+	token string
+}
+
+func (d *Downloader) registry(ref *ociReference) *registry {
+	return &registry{d: d, base: "https://" + ref.registry + "/v2/", ref: ref}
+}
+
+func (r *registry) url(kind, reference string) string {
+	return r.base + r.ref.repository + "/" + kind + "/" + reference
+}
+
+func (r *registry) header() http.Header {
+	header := http.Header{}
+	if r.token != "" {
+		header.Set("Authorization", "Bearer "+r.token)
+	}
+	return header
+}
+
+// get requests the given url and authenticates with a token if the registry requires it.
+func (r *registry) get(source string, accept ...string) (*http.Response, error) {
+	for authenticated := false; ; authenticated = true {
+		//nolint:noctx
+		req, err := http.NewRequest(http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = r.header()
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		resp, err := r.d.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !authenticated {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			err = r.authenticate(challenge)
+			if err != nil {
+				return nil, fmt.Errorf("unable to authenticate at registry %s %w", r.ref.registry, err)
+			}
+			continue
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			resp.Body.Close()
+			return nil, statusError(source, resp)
+		}
+		return resp, nil
+	}
+}
+
+// authenticate fetches an anonymous pull token as requested by the challenge of the registry, see
+// https://distribution.github.io/distribution/spec/auth/token/
+func (r *registry) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return fmt.Errorf("unsupported authentication %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("invalid realm %s %w", params["realm"], err)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.ref.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	//nolint:noctx
+	resp, err := r.d.client.Get(realm.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return statusError(realm.String(), resp)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token)
+	if err != nil {
+		return fmt.Errorf("unable to decode token %w", err)
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("no token received from %s", realm.Host)
+	}
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like: Bearer realm="https://auth",service="registry"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(rest[:eq])
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		params[strings.ToLower(key)] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
+
+// manifest fetches the manifest with the given tag or digest, manifests referenced by digest are verified.
+func (r *registry) manifest(reference string) (*ociManifest, error) {
+	resp, err := r.get(r.url("manifests", reference), mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerManifestList, mediaTypeDockerManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest %s %w", reference, err)
+	}
+	if strings.Contains(reference, ":") {
+		err = verifyDigest(reference, content)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s is invalid %w", reference, err)
+		}
+	}
+	m := &ociManifest{}
+	err = json.Unmarshal(content, m)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest %s %w", reference, err)
+	}
+	return m, nil
+}
+
+// imageManifest resolves the reference to the image manifest of the architecture of this machine.
+func (r *registry) imageManifest() (*ociManifest, error) {
+	m, err := r.manifest(r.ref.manifestReference())
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) == 0 {
+		return m, nil
+	}
+	// an image index references the manifests of all platforms
+	descriptor, err := selectPlatform(m.Manifests, runtime.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("oci image", "platform", descriptor.Platform, "manifest", descriptor.Digest)
+	return r.manifest(descriptor.Digest)
+}
+
+func (r *ociReference) manifestReference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
+// selectPlatform returns the manifest for linux on the given architecture from an image index.
+func selectPlatform(manifests []ociDescriptor, architecture string) (*ociDescriptor, error) {
+	for i := range manifests {
+		p := manifests[i].Platform
+		if p != nil && p.OS == "linux" && p.Architecture == architecture {
+			return &manifests[i], nil
+		}
+	}
+	return nil, fmt.Errorf("image contains no manifest for linux/%s", architecture)
+}
+
+// burnOCI applies all layers of the oci image in order into prefix, every layer is verified by its digest.
+func (d *Downloader) burnOCI(prefix, image string, policy Policy) ([]Layer, error) {
+	ref, err := parseOCIReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if policy.RequireSignature && ref.digest == "" {
+		return nil, fmt.Errorf("oci image %s must be referenced by digest if signed images are required", image)
+	}
+	log.Info("burn oci image", "registry", ref.registry, "repository", ref.repository, "tag", ref.tag, "digest", ref.digest)
+	begin := time.Now()
+
+	r := d.registry(ref)
+	m, err := r.imageManifest()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch manifest of %s %w", image, err)
+	}
+
+	var size int64
+	for _, layer := range m.Layers {
+		switch layer.MediaType {
+		case mediaTypeOCILayer, mediaTypeOCILayerGzip, mediaTypeOCILayerZstd, mediaTypeDockerLayer, mediaTypeOCINondistributable:
+		default:
+			return nil, fmt.Errorf("unsupported layer %s of type %s", layer.Digest, layer.MediaType)
+		}
+		size += layer.Size
+	}
+
+	bar := pb.New64(size)
+	bar.Set(pb.Bytes, true)
+	bar.Start()
+	bar.SetWidth(80)
+
+	layers := []Layer{}
+	for i, layer := range m.Layers {
+		log.Info("apply layer", "number", i+1, "of", len(m.Layers), "digest", layer.Digest, "size", layer.Size)
+		err = r.applyLayer(prefix, layer, bar)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply layer %s of %s %w", layer.Digest, image, err)
+		}
+		layers = append(layers, Layer{URL: image, Digest: layer.Digest})
+	}
+	bar.Finish()
+
+	log.Info("burn took", "duration", time.Since(begin))
+	return layers, nil
+}
+
+func (r *registry) applyLayer(prefix string, layer ociDescriptor, bar *pb.ProgressBar) error {
+	h, expected, err := digestHash(layer.Digest)
+	if err != nil {
+		return err
+	}
+	// blobs are usually redirected to a storage backend, the download resumes from there
+	dl, err := r.d.openURLs([]string{r.url("blobs", layer.Digest)}, r.header())
+	if err != nil {
+		return err
+	}
+	defer dl.Close()
+
+	body := io.TeeReader(bar.NewProxyReader(dl), h)
+	reader, _, err := decompress(body)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	stats, err := extractLayer(reader, prefix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, body)
+	if err != nil {
+		return err
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	if sum != expected {
+		return fmt.Errorf("digest mismatch, got %s expected %s", sum, layer.Digest)
+	}
+	log.Info("layer extracted", append([]interface{}{"digest", layer.Digest}, stats.logContext()...)...)
+	return nil
+}
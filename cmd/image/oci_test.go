@@ -0,0 +1,231 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/cheggaaa/pb/v3"
+)
+
+func TestParseOCIReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		image   string
+		want    *ociReference
+		wantErr bool
+	}{
+		{
+			image: "oci://ghcr.io/metal-stack/ubuntu:22.04",
+			want:  &ociReference{registry: "ghcr.io", repository: "metal-stack/ubuntu", tag: "22.04"},
+		},
+		{
+			image: "oci://registry.local:5000/os/debian@" + digest,
+			want:  &ociReference{registry: "registry.local:5000", repository: "os/debian", tag: "latest", digest: digest},
+		},
+		{
+			image: "oci://registry.local:5000/os/debian:11@" + digest,
+			want:  &ociReference{registry: "registry.local:5000", repository: "os/debian", tag: "11", digest: digest},
+		},
+		{image: "oci://registry.local", wantErr: true},
+		{image: "oci://registry.local/debian:", wantErr: true},
+		{image: "oci://registry.local/debian@md5:abc", wantErr: true},
+		{image: "http://images.metal-stack.io/img.tar.lz4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := parseOCIReference(tt.image)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOCIReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOCIReference() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"`)
+	want := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/ubuntu:pull",
+	}
+	if scheme != "Bearer" || !reflect.DeepEqual(params, want) {
+		t.Errorf("parseChallenge() = %s %v, want Bearer %v", scheme, params, want)
+	}
+}
+
+func digestOf(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// testRegistry serves an image index with one image of two layers and requires a token
+func testRegistry(t *testing.T, layers ...[]byte) (*httptest.Server, string) {
+	blobs := map[string][]byte{}
+	manifest := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest}
+	for _, l := range layers {
+		digest := digestOf(l)
+		blobs[digest] = l
+		manifest.Layers = append(manifest.Layers, ociDescriptor{MediaType: mediaTypeOCILayerGzip, Digest: digest, Size: int64(len(l))})
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{
+		{MediaType: mediaTypeOCIManifest, Digest: "sha256:" + strings.Repeat("0", 64), Platform: &ociPlatform{OS: "linux", Architecture: "s390x"}},
+		{MediaType: mediaTypeOCIManifest, Digest: digestOf(manifestJSON), Platform: &ociPlatform{OS: "linux", Architecture: runtime.GOARCH}},
+	}}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.URL.Query().Get("scope") != "repository:metal/ubuntu:pull" {
+				http.Error(w, "invalid scope", http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"secret"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v2/metal/ubuntu/manifests/22.04":
+			w.Header().Set("Content-Type", mediaTypeOCIIndex)
+			_, _ = w.Write(indexJSON)
+		case r.URL.Path == "/v2/metal/ubuntu/manifests/"+digestOf(manifestJSON):
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			_, _ = w.Write(manifestJSON)
+		case strings.HasPrefix(r.URL.Path, "/v2/metal/ubuntu/blobs/"):
+			blob, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/metal/ubuntu/blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server, strings.TrimPrefix(server.URL, "https://")
+}
+
+func TestBurnOCI(t *testing.T) {
+	lower := gzipped(t, testArchive(t, []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "lower"},
+		{hdr: tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg}, content: "welcome"},
+		{hdr: tar.Header{Name: "var/cache/apt/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "var/cache/apt/pkgcache.bin", Typeflag: tar.TypeReg}, content: "cache"},
+		{hdr: tar.Header{Name: "var/cache/apt/archives/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "var/cache/apt/archives/lock", Typeflag: tar.TypeReg}, content: "lock"},
+		{hdr: tar.Header{Name: "var/cache/apt/archives/partial/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "var/cache/apt/archives/partial/vim.deb", Typeflag: tar.TypeReg}, content: "vim"},
+	}))
+	upper := gzipped(t, testArchive(t, []testEntry{
+		{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "upper"},
+		{hdr: tar.Header{Name: "etc/.wh.motd", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "etc/os-release", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib/os-release"}},
+		{hdr: tar.Header{Name: "var/cache/apt/archives/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "var/cache/apt/archives/partial/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "var/cache/apt/archives/partial/curl.deb", Typeflag: tar.TypeReg}, content: "curl"},
+		{hdr: tar.Header{Name: "var/cache/apt/.wh..wh..opq", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "bin/sh", Typeflag: tar.TypeReg}, content: "#!"},
+		{hdr: tar.Header{Name: "bin/bash", Typeflag: tar.TypeLink, Linkname: "bin/sh"}},
+	}))
+	server, host := testRegistry(t, lower, upper)
+	defer server.Close()
+
+	d := testDownloader(t)
+	d.client = server.Client()
+	prefix := t.TempDir()
+	layers, err := d.Burn(prefix, "oci://"+host+"/metal/ubuntu:22.04", nil, Policy{})
+	if err != nil {
+		t.Fatalf("Burn() error = %v", err)
+	}
+	if len(layers) != 2 || layers[0].Digest != fmt.Sprintf("sha256:%x", sha256.Sum256(lower)) || layers[1].Digest != fmt.Sprintf("sha256:%x", sha256.Sum256(upper)) {
+		t.Errorf("Burn() layers = %v, want the digests of both layers", layers)
+	}
+
+	content, err := os.ReadFile(filepath.Join(prefix, "etc", "hostname"))
+	if err != nil || string(content) != "upper" {
+		t.Errorf("etc/hostname = %q %v, want upper", content, err)
+	}
+	for _, removed := range []string{
+		"etc/motd", "etc/.wh.motd", "var/cache/apt/pkgcache.bin", "var/cache/apt/.wh..wh..opq",
+		"var/cache/apt/archives/lock", "var/cache/apt/archives/partial/vim.deb",
+	} {
+		if _, err := os.Lstat(filepath.Join(prefix, removed)); !os.IsNotExist(err) {
+			t.Errorf("%s exists, expected it to be removed by a whiteout", removed)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(prefix, "var", "cache", "apt", "archives")); err != nil || !info.IsDir() {
+		t.Errorf("var/cache/apt/archives of the upper layer was removed by the opaque whiteout %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "var", "cache", "apt", "archives", "partial", "curl.deb")); err != nil {
+		t.Errorf("var/cache/apt/archives/partial/curl.deb of the upper layer was removed by the opaque whiteout %v", err)
+	}
+	link, err := os.Readlink(filepath.Join(prefix, "etc", "os-release"))
+	if err != nil || link != "../usr/lib/os-release" {
+		t.Errorf("etc/os-release = %q %v, want symlink to ../usr/lib/os-release", link, err)
+	}
+	sh, err := os.Stat(filepath.Join(prefix, "bin", "sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bash, err := os.Stat(filepath.Join(prefix, "bin", "bash"))
+	if err != nil || !os.SameFile(sh, bash) {
+		t.Errorf("bin/bash is not a hardlink of bin/sh %v", err)
+	}
+
+	_, err = d.Burn(t.TempDir(), "oci://"+host+"/metal/ubuntu:22.04", nil, Policy{RequireSignature: true})
+	if err == nil || !strings.Contains(err.Error(), "must be referenced by digest") {
+		t.Errorf("Burn() error = %v, want digest required", err)
+	}
+}
+
+func TestBurnOCIDigestMismatch(t *testing.T) {
+	layer := gzipped(t, testArchive(t, []testEntry{{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "metal"}}))
+	server, host := testRegistry(t, layer)
+	defer server.Close()
+
+	d := testDownloader(t)
+	d.client = server.Client()
+	_, err := d.Burn(t.TempDir(), "oci://"+host+"/metal/ubuntu@sha256:"+strings.Repeat("1", 64), nil, Policy{})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Burn() error = %v, want unknown manifest", err)
+	}
+
+	tampered := gzipped(t, testArchive(t, []testEntry{{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "evil"}}))
+	blobs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(tampered)
+	}))
+	defer blobs.Close()
+
+	d.client = blobs.Client()
+	r := d.registry(&ociReference{registry: strings.TrimPrefix(blobs.URL, "https://"), repository: "metal/ubuntu"})
+	err = r.applyLayer(t.TempDir(), ociDescriptor{MediaType: mediaTypeOCILayerGzip, Digest: digestOf(layer)}, pb.New64(0))
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("applyLayer() error = %v, want digest mismatch", err)
+	}
+}
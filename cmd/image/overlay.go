@@ -0,0 +1,38 @@
+package image
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// BurnOverlays extracts the given tarballs in order on top of the content of prefix, e.g. site specific files on top of
+// a base image. Every overlay is pulled and verified like an image, with its own checksum file and signature.
+// Entries which replace entries of the image or of a previous overlay are logged, directories are merged.
+// The digests of the overlays are returned.
+func (d *Downloader) BurnOverlays(prefix string, overlays []string, policy Policy) ([]Layer, error) {
+	// owners are shared by all overlays to log which overlay wrote a replaced entry
+	owners := make(map[string]string)
+	layers := []Layer{}
+	for i, overlay := range overlays {
+		if IsOCI(overlay) {
+			return nil, fmt.Errorf("overlay %s can not be pulled from an oci registry", overlay)
+		}
+		log.Info("burn overlay", "number", i+1, "of", len(overlays), "overlay", overlay)
+		e := &extractor{prefix: prefix, overlay: overlay, owners: owners}
+		sum, err := d.burn(overlay, policy, decompress, func(r io.Reader) error {
+			stats, err := e.extractTar(r)
+			if err != nil {
+				return err
+			}
+			log.Info("overlay extracted", append([]interface{}{"overlay", overlay}, stats.logContext()...)...)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to burn overlay %w", err)
+		}
+		layers = append(layers, Layer{URL: overlay, Digest: sum.digest()})
+	}
+	return layers, nil
+}
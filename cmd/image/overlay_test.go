@@ -0,0 +1,99 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBurnOverlays(t *testing.T) {
+	image := gzipped(t, testTar(t))
+	site := gzipped(t, testArchive(t, []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "site"},
+		{hdr: tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg}, content: "welcome"},
+	}))
+	rack := gzipped(t, testArchive(t, []testEntry{
+		{hdr: tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg}, content: "rack 42"},
+		{hdr: tar.Header{Name: "etc/rack", Typeflag: tar.TypeReg}, content: "42"},
+	}))
+	server := newImageServer(t, map[string][]byte{"/base.tar.gz": image, "/site.tar.gz": site, "/rack.tar.gz": rack}, "")
+	defer server.Close()
+
+	prefix := t.TempDir()
+	base, overlays := server.URL+"/base.tar.gz", []string{server.URL + "/site.tar.gz", server.URL + "/rack.tar.gz"}
+	layers, err := testDownloader(t).Burn(prefix, base, overlays, Policy{})
+	if err != nil {
+		t.Fatalf("Burn() error = %v", err)
+	}
+	want := []Layer{
+		{URL: base, Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(image))},
+		{URL: overlays[0], Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(site))},
+		{URL: overlays[1], Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(rack))},
+	}
+	if !reflect.DeepEqual(layers, want) {
+		t.Errorf("Burn() layers = %v, want %v", layers, want)
+	}
+	for name, want := range map[string]string{"hostname": "site", "motd": "rack 42", "rack": "42"} {
+		content, err := os.ReadFile(filepath.Join(prefix, "etc", name))
+		if err != nil || string(content) != want {
+			t.Errorf("etc/%s = %q %v, want %q", name, content, err, want)
+		}
+	}
+
+	_, err = testDownloader(t).Burn(t.TempDir(), base, []string{server.URL + "/missing.tar.gz"}, Policy{})
+	if err == nil || !strings.Contains(err.Error(), "unable to burn overlay") {
+		t.Errorf("Burn() error = %v, want missing overlay", err)
+	}
+	_, err = testDownloader(t).Burn(t.TempDir(), base, []string{"oci://registry.local/site:latest"}, Policy{})
+	if err == nil || !strings.Contains(err.Error(), "oci registry") {
+		t.Errorf("Burn() error = %v, want oci not supported", err)
+	}
+}
+
+func TestExtractOverlayConflicts(t *testing.T) {
+	prefix := t.TempDir()
+	_, err := extractTar(bytes.NewReader(testTar(t)), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners := make(map[string]string)
+	for _, overlay := range []struct {
+		url          string
+		entries      []testEntry
+		wantReplaced int
+	}{
+		{
+			url: "site",
+			entries: []testEntry{
+				{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+				{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "site"},
+			},
+			wantReplaced: 1,
+		},
+		{
+			url:          "rack",
+			entries:      []testEntry{{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeSymlink, Linkname: "rack"}}},
+			wantReplaced: 1,
+		},
+	} {
+		e := &extractor{prefix: prefix, overlay: overlay.url, owners: owners}
+		stats, err := e.extractTar(bytes.NewReader(testArchive(t, overlay.entries)))
+		if err != nil {
+			t.Fatalf("extractTar() of overlay %s error = %v", overlay.url, err)
+		}
+		if stats.replaced != overlay.wantReplaced {
+			t.Errorf("overlay %s replaced %d entries, want %d", overlay.url, stats.replaced, overlay.wantReplaced)
+		}
+	}
+	if owner := owners[filepath.Join(prefix, "etc", "hostname")]; owner != "rack" {
+		t.Errorf("owner of etc/hostname = %q, want rack", owner)
+	}
+}
@@ -0,0 +1,211 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/sys/unix"
+)
+
+// PersistentCacheDir is the mount point of the image cache filesystem of the layout, outside of the chroot
+const PersistentCacheDir = "/var/lib/metal-hammer/images"
+
+// incompletePrefix of images which are written to the persistent cache, they are renamed once the image is verified
+const incompletePrefix = ".incomplete-"
+
+// PersistentCache keeps verified images on a dedicated filesystem which survives reinstalls.
+// Images are stored by the digest of their checksum file, the modification time of an image is its last use,
+// the least recently used images are evicted if the filesystem is full.
+type PersistentCache struct {
+	dir string
+}
+
+// OpenPersistentCache opens the persistent cache in dir, images of interrupted installations are removed.
+func OpenPersistentCache(dir string) (*PersistentCache, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open image cache %s %w", dir, err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), incompletePrefix) {
+			log.Info("remove incomplete image from cache", "file", e.Name())
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return &PersistentCache{dir: dir}, nil
+}
+
+// file returns the path of the image with the given checksum, images with weak checksums are not cached
+// because another image with the same checksum could be placed into the cache.
+func (p *PersistentCache) file(sum *checksum) string {
+	if p == nil || sum.algorithm.weak {
+		return ""
+	}
+	return filepath.Join(p.dir, fmt.Sprintf("%s-%s", sum.algorithm.name, sum.sum))
+}
+
+// open returns the cached image with the given checksum, nil if it is not cached. The cached image is verified
+// before it is used, because the cache is writable by the previous installation, a corrupted image is removed.
+func (p *PersistentCache) open(sum *checksum) *cachedImage {
+	file := p.file(sum)
+	if file == "" {
+		return nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Warn("unable to open cached image", "file", file, "error", err)
+		return nil
+	}
+	h := sum.algorithm.hash()
+	size, err := io.Copy(h, f)
+	if err == nil && fmt.Sprintf("%x", h.Sum(nil)) != sum.sum {
+		err = fmt.Errorf("%s mismatch", sum.algorithm.name)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		log.Warn("remove corrupted image from cache", "file", file, "error", err)
+		_ = os.Remove(file)
+		return nil
+	}
+	now := time.Now()
+	err = os.Chtimes(file, now, now)
+	if err != nil {
+		log.Warn("unable to mark cached image as used", "file", file, "error", err)
+	}
+	return &cachedImage{File: f, size: size}
+}
+
+// create returns a writer which stores the image with the given checksum and size in the cache. Least recently used images
+// are evicted until the image fits, nil is returned if the image is already cached or can not be cached.
+func (p *PersistentCache) create(sum *checksum, size int64) *cacheWriter {
+	file := p.file(sum)
+	if file == "" || size < 0 {
+		return nil
+	}
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	err := p.evict(size)
+	if err != nil {
+		log.Warn("image is not cached", "file", file, "error", err)
+		return nil
+	}
+	f, err := os.CreateTemp(p.dir, incompletePrefix+"*")
+	if err != nil {
+		log.Warn("image is not cached", "file", file, "error", err)
+		return nil
+	}
+	return &cacheWriter{f: f, file: file}
+}
+
+// evict removes the least recently used images until size bytes are available.
+func (p *PersistentCache) evict(size int64) error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	type image struct {
+		name    string
+		lastUse time.Time
+	}
+	images := []image{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		images = append(images, image{name: e.Name(), lastUse: info.ModTime()})
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].lastUse.Before(images[j].lastUse) })
+
+	for {
+		available, err := availableBytes(p.dir)
+		if err != nil {
+			return err
+		}
+		if available >= size {
+			return nil
+		}
+		if len(images) == 0 {
+			return fmt.Errorf("image of %d bytes does not fit into the cache with %d bytes available", size, available)
+		}
+		log.Info("evict least recently used image from cache", "file", images[0].name, "last use", images[0].lastUse)
+		err = os.Remove(filepath.Join(p.dir, images[0].name))
+		if err != nil {
+			return err
+		}
+		images = images[1:]
+	}
+}
+
+// availableBytes returns the free space of the filesystem of dir.
+var availableBytes = func(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get free space of %s %w", dir, err)
+	}
+	return int64(stat.Bavail) * stat.Bsize, nil
+}
+
+// cacheWriter writes an image into the persistent cache while it is burned. Write errors do not abort burning,
+// the image is not cached then.
+type cacheWriter struct {
+	f    *os.File
+	file string
+	err  error
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.f.Write(p)
+	}
+	return len(p), nil
+}
+
+// commit stores the completely written and verified image in the cache.
+func (w *cacheWriter) commit() {
+	if w == nil {
+		return
+	}
+	err := w.err
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.file)
+	}
+	if err != nil {
+		log.Warn("image is not cached", "file", w.file, "error", err)
+		_ = os.Remove(w.f.Name())
+		return
+	}
+	log.Info("image cached", "file", w.file)
+}
+
+// discard removes the image if it was not committed.
+func (w *cacheWriter) discard() {
+	if w == nil {
+		return
+	}
+	w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
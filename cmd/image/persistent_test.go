@@ -0,0 +1,127 @@
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistentCache(t *testing.T) {
+	image := gzipped(t, testTar(t))
+	server := newImageServer(t, map[string][]byte{"/a.tar.gz": image}, "")
+	defer server.Close()
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, incompletePrefix+"1234"), []byte("interrupted"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, fmt.Sprintf("sha256-%x", sha256.Sum256(image)))
+
+	burn := func() {
+		cache, err := OpenPersistentCache(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := testDownloader(t)
+		d.UsePersistentCache(cache)
+		_, err = d.Burn(t.TempDir(), server.URL+"/a.tar.gz", nil, Policy{})
+		if err != nil {
+			t.Fatalf("Burn() error = %v", err)
+		}
+	}
+
+	burn()
+	if _, err := os.Stat(filepath.Join(dir, incompletePrefix+"1234")); !os.IsNotExist(err) {
+		t.Errorf("incomplete image was not removed")
+	}
+	content, err := os.ReadFile(file)
+	if err != nil || string(content) != string(image) {
+		t.Fatalf("image was not cached %v", err)
+	}
+
+	burn()
+	if server.count("/a.tar.gz") != 1 {
+		t.Errorf("cached image was pulled %d times, want once", server.count("/a.tar.gz"))
+	}
+
+	// a corrupted image is pulled again and replaced
+	err = os.WriteFile(file, []byte("corrupted"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	burn()
+	if server.count("/a.tar.gz") != 2 {
+		t.Errorf("corrupted image was pulled %d times, want twice", server.count("/a.tar.gz"))
+	}
+	content, err = os.ReadFile(file)
+	if err != nil || string(content) != string(image) {
+		t.Errorf("corrupted image was not replaced %v", err)
+	}
+}
+
+func TestPersistentCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	const capacity = 100
+	defer func(f func(string) (int64, error)) { availableBytes = f }(availableBytes)
+	availableBytes = func(dir string) (int64, error) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		used := int64(0)
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return 0, err
+			}
+			used += info.Size()
+		}
+		return capacity - used, nil
+	}
+
+	now := time.Now()
+	for i, name := range []string{"sha256-old", "sha256-recent", "sha256-oldest"} {
+		file := filepath.Join(dir, name)
+		err := os.WriteFile(file, make([]byte, 30), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastUse := now.Add(-time.Duration(i+1) * time.Hour)
+		if name == "sha256-recent" {
+			lastUse = now
+		}
+		err = os.Chtimes(file, lastUse, lastUse)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache, err := OpenPersistentCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.evict(50)
+	if err != nil {
+		t.Fatalf("evict() error = %v", err)
+	}
+	for name, want := range map[string]bool{"sha256-oldest": false, "sha256-old": false, "sha256-recent": true} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if (err == nil) != want {
+			t.Errorf("%s kept = %t, want %t", name, err == nil, want)
+		}
+	}
+
+	err = cache.evict(capacity + 1)
+	if err == nil {
+		t.Errorf("evict() of an image larger than the cache expected error")
+	}
+
+	sum := &checksum{algorithm: checksumAlgorithms[2], sum: "d41d8cd98f00b204e9800998ecf8427e"}
+	if w := cache.create(sum, 1); w != nil {
+		t.Errorf("image with weak checksum was cached")
+	}
+}
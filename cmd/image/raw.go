@@ -0,0 +1,51 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// rawBufferSize is the size of the writes to the block device
+const rawBufferSize = 4 * 1024 * 1024
+
+// BurnRaw streams a raw disk image, which contains its own partition table, from the given url through decompression
+// onto the block device. Like Burn, the image is hashed while it is written and burning fails if the checksum does
+// not match. The backup gpt header of the image is not at the end of the device afterwards and must be repaired.
+// The digest of the image is returned.
+func (d *Downloader) BurnRaw(device, image string, policy Policy) ([]Layer, error) {
+	if IsOCI(image) {
+		return nil, fmt.Errorf("raw image %s can not be pulled from an oci registry", image)
+	}
+	log.Info("burn raw image", "image", image, "device", device)
+	sum, err := d.burn(image, policy, decompressRaw, func(r io.Reader) error {
+		return writeDevice(r, device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []Layer{{URL: image, Digest: sum.digest()}}, nil
+}
+
+// writeDevice writes the content of r to the beginning of device and flushes it to disk,
+// opening the device fails if it is in use.
+func writeDevice(r io.Reader, device string) error {
+	f, err := os.OpenFile(device, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open %s %w", device, err)
+	}
+	written, err := io.CopyBuffer(f, r, make([]byte, rawBufferSize))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write %s after %d bytes %w", device, written, err)
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync %s %w", device, err)
+	}
+	log.Info("burn raw image", "device", device, "bytes", written)
+	return f.Close()
+}
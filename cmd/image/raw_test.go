@@ -0,0 +1,86 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBurnRaw(t *testing.T) {
+	// a protective mbr followed by the gpt header, raw images have no magic at the beginning
+	disk := append(make([]byte, 510), 0x55, 0xaa)
+	disk = append(disk, []byte("EFI PART")...)
+	disk = append(disk, bytes.Repeat([]byte{0xa5}, 64*1024)...)
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		image   []byte
+		wantErr string
+	}{
+		{name: "uncompressed", image: disk},
+		{name: "gzip", image: compressed.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/disk.img":
+					_, _ = w.Write(tt.image)
+				case "/disk.img.sha256":
+					_, _ = w.Write([]byte(fmt.Sprintf("%x  disk.img\n", sha256.Sum256(tt.image))))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			// the device is larger than the image, the remaining content must be kept
+			device := filepath.Join(t.TempDir(), "sda")
+			err := os.WriteFile(device, bytes.Repeat([]byte{0xff}, len(disk)+4096), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			layers, err := testDownloader(t).BurnRaw(device, server.URL+"/disk.img", Policy{})
+			if err != nil {
+				t.Fatalf("BurnRaw() error = %v", err)
+			}
+			if len(layers) != 1 || layers[0].Digest != fmt.Sprintf("sha256:%x", sha256.Sum256(tt.image)) {
+				t.Errorf("BurnRaw() layers = %v, want the digest of the image", layers)
+			}
+			content, err := os.ReadFile(device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content[:len(disk)], disk) {
+				t.Errorf("BurnRaw() content of the device differs from the image")
+			}
+			if !bytes.Equal(content[len(disk):], bytes.Repeat([]byte{0xff}, 4096)) {
+				t.Errorf("BurnRaw() overwrote the device behind the image")
+			}
+		})
+	}
+
+	_, err = testDownloader(t).BurnRaw(filepath.Join(t.TempDir(), "sda"), "oci://registry.local/disk:latest", Policy{})
+	if err == nil || !strings.Contains(err.Error(), "oci registry") {
+		t.Errorf("BurnRaw() error = %v, want oci not supported", err)
+	}
+}
@@ -0,0 +1,272 @@
+package image
+
+import (
+	"bytes"
+	"crypto/ed25519"
+
+	//nolint:gosec
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/blake2b"
+)
+
+// KeyDir contains the trusted public keys of image signatures which are part of the initrd
+const KeyDir = "/etc/metal/image-keys"
+
+// signatureSuffix is appended to the checksum file of an image to get its minisign signature
+const signatureSuffix = ".minisig"
+
+// checksumAlgorithm is the hash of a checksum file which is published next to an image
+type checksumAlgorithm struct {
+	name   string
+	suffix string
+	hash   func() hash.Hash
+	// weak checksums can be forged and do not protect an image even if they are signed
+	weak bool
+}
+
+// checksumAlgorithms in the order of preference
+var checksumAlgorithms = []checksumAlgorithm{
+	{name: "sha512", suffix: ".sha512", hash: sha512.New},
+	{name: "sha256", suffix: ".sha256", hash: sha256.New},
+	{name: "md5", suffix: ".md5", hash: md5.New, weak: true},
+}
+
+// Policy defines how the integrity and authenticity of images is verified
+type Policy struct {
+	// Keys are the trusted minisign public keys of image signatures
+	Keys []PublicKey
+	// RequireSignature refuses images whose checksum file is not signed by one of the keys
+	RequireSignature bool
+}
+
+// PublicKey is a minisign ed25519 public key
+type PublicKey struct {
+	ID  [8]byte
+	Key ed25519.PublicKey
+}
+
+// checksum of an image, read from the checksum file next to it
+type checksum struct {
+	algorithm checksumAlgorithm
+	file      string
+	content   []byte
+	sum       string
+}
+
+// digest returns the checksum in the form algorithm:hex, like the digests of oci layers.
+func (c *checksum) digest() string {
+	return c.algorithm.name + ":" + c.sum
+}
+
+// fetchChecksum fetches the strongest checksum file which is published next to the image and verifies its signature
+// according to the policy.
+func (d *Downloader) fetchChecksum(image string, policy Policy) (*checksum, error) {
+	for _, a := range checksumAlgorithms {
+		file := image + a.suffix
+		content, err := d.fetch(file)
+		if err != nil {
+			if isNotFound(err) {
+				log.Debug("no checksum file found", "file", file)
+				continue
+			}
+			return nil, err
+		}
+		sum, name, err := parseChecksum(file, content)
+		if err != nil {
+			return nil, err
+		}
+		c := &checksum{algorithm: a, file: file, content: content, sum: sum}
+		err = d.verifySignature(c, policy)
+		if err != nil {
+			return nil, err
+		}
+		err = verifyChecksumName(image, c, name, policy)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("no checksum file of image %s found", image)
+}
+
+// verifySignature verifies the signature of the checksum file if the policy requires a signature or trusted keys are given.
+func (d *Downloader) verifySignature(c *checksum, policy Policy) error {
+	if policy.RequireSignature && c.algorithm.weak {
+		return fmt.Errorf("%s checksum %s is not sufficient for signed images", c.algorithm.name, c.file)
+	}
+	if len(policy.Keys) == 0 {
+		if policy.RequireSignature {
+			return fmt.Errorf("image signature required but no trusted keys are present in %s", KeyDir)
+		}
+		log.Warn("image signature not verified, no trusted keys present", "checksum", c.file)
+		return nil
+	}
+
+	signatureFile := c.file + signatureSuffix
+	signature, err := d.fetch(signatureFile)
+	if err != nil {
+		if isNotFound(err) && !policy.RequireSignature {
+			log.Warn("image is not signed", "checksum", c.file)
+			return nil
+		}
+		return fmt.Errorf("unable to pull signature %s %w", signatureFile, err)
+	}
+	key, err := verifyMinisign(policy.Keys, c.content, signature)
+	if err != nil {
+		return fmt.Errorf("signature %s is invalid %w", signatureFile, err)
+	}
+	log.Info("image signature verified", "checksum", c.file, "key", keyID(key.ID[:]))
+	return nil
+}
+
+// verifyChecksumName checks that the checksum file was created for the image, the signature only covers the content
+// of the checksum file, without the name a signed checksum file of any other image could be served next to the image.
+func verifyChecksumName(image string, c *checksum, name string, policy Policy) error {
+	want := path.Base(image)
+	if u, err := url.Parse(image); err == nil {
+		want = path.Base(u.Path)
+	}
+	if name == want {
+		return nil
+	}
+	if policy.RequireSignature {
+		return fmt.Errorf("checksum file %s is for %q and not for image %s", c.file, name, want)
+	}
+	log.Warn("checksum file is not for the image", "checksum", c.file, "name", name, "image", want)
+	return nil
+}
+
+// parseChecksum returns the checksum and the base name of the file of a checksum file in the form:
+// <checksum> filename
+// this is the same format as created by the "sha256sum" unix command, the name is empty if it is missing
+func parseChecksum(file string, content []byte) (string, string, error) {
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("checksum file %s is empty", file)
+	}
+	name := ""
+	if len(fields) > 1 {
+		// sha256sum marks files which were read in binary mode with *
+		name = path.Base(strings.TrimPrefix(fields[1], "*"))
+	}
+	return strings.ToLower(fields[0]), name, nil
+}
+
+// LoadPublicKeys reads all minisign public keys with the extension .pub from the given directory,
+// a missing directory contains no keys.
+func LoadPublicKeys(dir string) ([]PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	keys := []PublicKey{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read public key %s %w", file, err)
+		}
+		key, err := ParsePublicKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse public key %s %w", file, err)
+		}
+		keys = append(keys, *key)
+	}
+	return keys, nil
+}
+
+// ParsePublicKey parses a minisign public key, either the base64 encoded key alone or
+// the content of a .pub file with an untrusted comment.
+func ParsePublicKey(content []byte) (*PublicKey, error) {
+	lines := minisignLines(content)
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("public key is empty")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[len(lines)-1])
+	if err != nil {
+		return nil, fmt.Errorf("public key is not base64 encoded %w", err)
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("public key is not a minisign ed25519 key")
+	}
+	key := &PublicKey{Key: ed25519.PublicKey(raw[10:])}
+	copy(key.ID[:], raw[2:10])
+	return key, nil
+}
+
+// verifyMinisign verifies the minisign signature of content with one of the keys and returns the key,
+// see https://jedisct1.github.io/minisign/#signature-format
+func verifyMinisign(keys []PublicKey, content, signature []byte) (*PublicKey, error) {
+	lines := minisignLines(signature)
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "trusted comment: ") {
+		return nil, fmt.Errorf("malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed minisign global signature")
+	}
+
+	message := content
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		// prehashed signatures of large files
+		h := blake2b.Sum512(content)
+		message = h[:]
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %q", string(sig[:2]))
+	}
+
+	for i := range keys {
+		key := &keys[i]
+		if !bytes.Equal(key.ID[:], sig[2:10]) {
+			continue
+		}
+		if !ed25519.Verify(key.Key, message, sig[10:]) {
+			return nil, fmt.Errorf("signature does not match")
+		}
+		trustedComment := strings.TrimPrefix(lines[1], "trusted comment: ")
+		if !ed25519.Verify(key.Key, append(append([]byte{}, sig[10:]...), trustedComment...), globalSig) {
+			return nil, fmt.Errorf("trusted comment does not match")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("signed with untrusted key %s", keyID(sig[2:10]))
+}
+
+// keyID formats a key id like minisign, which prints it as little endian number.
+func keyID(id []byte) string {
+	reversed := make([]byte, len(id))
+	for i := range id {
+		reversed[len(id)-1-i] = id[i]
+	}
+	return fmt.Sprintf("%X", reversed)
+}
+
+// minisignLines returns all lines of a minisign file without the untrusted comment.
+func minisignLines(content []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
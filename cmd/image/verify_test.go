@@ -0,0 +1,149 @@
+package image
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func testKey(t *testing.T, id byte) (PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PublicKey{ID: [8]byte{id, 1, 2, 3, 4, 5, 6, 7}, Key: pub}, priv
+}
+
+// minisign creates a signature in the format of minisign -S
+func minisign(key PublicKey, priv ed25519.PrivateKey, content []byte, prehashed bool, trustedComment string) []byte {
+	algorithm := "Ed"
+	message := content
+	if prehashed {
+		algorithm = "ED"
+		h := blake2b.Sum512(content)
+		message = h[:]
+	}
+	sig := append(append([]byte(algorithm), key.ID[:]...), ed25519.Sign(priv, message)...)
+	globalSig := ed25519.Sign(priv, append(append([]byte{}, sig[10:]...), trustedComment...))
+	return []byte(fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(sig), trustedComment, base64.StdEncoding.EncodeToString(globalSig)))
+}
+
+func publicKeyFile(key PublicKey) []byte {
+	raw := append(append([]byte("Ed"), key.ID[:]...), key.Key...)
+	return []byte("untrusted comment: minisign public key " + keyID(key.ID[:]) + "\n" + base64.StdEncoding.EncodeToString(raw) + "\n")
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	key, priv := testKey(t, 1)
+	other, otherPriv := testKey(t, 2)
+	content := []byte("4f1a0b  img.tar.lz4\n")
+
+	tests := []struct {
+		name      string
+		keys      []PublicKey
+		signature []byte
+		wantErr   string
+	}{
+		{
+			name:      "valid",
+			keys:      []PublicKey{other, key},
+			signature: minisign(key, priv, content, false, "timestamp:1666000000"),
+		},
+		{
+			name:      "valid prehashed",
+			keys:      []PublicKey{key},
+			signature: minisign(key, priv, content, true, "timestamp:1666000000"),
+		},
+		{
+			name:      "other content",
+			keys:      []PublicKey{key},
+			signature: minisign(key, priv, []byte("d41d8cd9  img.tar.lz4\n"), true, "timestamp:1666000000"),
+			wantErr:   "signature does not match",
+		},
+		{
+			name: "modified trusted comment",
+			keys: []PublicKey{key},
+			signature: []byte(strings.Replace(string(minisign(key, priv, content, false, "timestamp:1666000000")),
+				"timestamp:1666000000", "timestamp:1999999999", 1)),
+			wantErr: "trusted comment does not match",
+		},
+		{
+			name:      "untrusted key",
+			keys:      []PublicKey{key},
+			signature: minisign(other, otherPriv, content, false, "timestamp:1666000000"),
+			wantErr:   "signed with untrusted key",
+		},
+		{
+			name:      "key id of a trusted key",
+			keys:      []PublicKey{key},
+			signature: minisign(key, otherPriv, content, false, "timestamp:1666000000"),
+			wantErr:   "signature does not match",
+		},
+		{
+			name:      "malformed",
+			keys:      []PublicKey{key},
+			signature: []byte("untrusted comment: nothing\nbm90aGluZw==\n"),
+			wantErr:   "malformed minisign signature",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyMinisign(tt.keys, content, tt.signature)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyMinisign() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyMinisign() error = %v", err)
+			}
+			if got.ID != key.ID {
+				t.Errorf("verifyMinisign() key = %s, want %s", keyID(got.ID[:]), keyID(key.ID[:]))
+			}
+		})
+	}
+}
+
+func TestLoadPublicKeys(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := testKey(t, 1)
+	err := os.WriteFile(filepath.Join(dir, "images.pub"), publicKeyFile(key), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "README"), []byte("no key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadPublicKeys(dir)
+	if err != nil {
+		t.Fatalf("LoadPublicKeys() error = %v", err)
+	}
+	if len(keys) != 1 || keys[0].ID != key.ID || !keys[0].Key.Equal(key.Key) {
+		t.Errorf("LoadPublicKeys() = %v, want %v", keys, key)
+	}
+
+	keys, err = LoadPublicKeys(filepath.Join(dir, "missing"))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("LoadPublicKeys() of missing directory = %v, %v, want no keys", keys, err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "invalid.pub"), []byte("untrusted comment: invalid\nbm90aGluZw==\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadPublicKeys(dir)
+	if err == nil {
+		t.Errorf("LoadPublicKeys() expected error for invalid key")
+	}
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/cmd/storage"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/kernel"
+	"github.com/metal-stack/v"
+)
+
+// ImageBuildSpec defines a installation into disk image files instead of physical disks.
+type ImageBuildSpec struct {
+	// Layout is the path to a filesystemlayout in json format
+	Layout string
+	// ImageURL of the OS image to install
+	ImageURL string
+	// OutputDir where the disk images and the manifest are written to
+	OutputDir string
+	// DiskSize of every disk image in MiB
+	DiskSize int64
+	// Format of the disk images, either raw or qcow2
+	Format string
+	// Hostname written to the installer configuration
+	Hostname string
+	// MachineUUID written to the installer configuration
+	MachineUUID string
+	// Console written to the installer configuration, the kernel command line of the build host is not used
+	Console string
+}
+
+// ImageManifest describes the disk images created by BuildDiskImages.
+type ImageManifest struct {
+	ImageURL  string              `json:"image_url"`
+	LayoutID  string              `json:"layout_id"`
+	Created   string              `json:"created"`
+	Version   string              `json:"metal_hammer_version"`
+	Bootinfo  *kernel.Bootinfo    `json:"bootinfo"`
+	DiskFiles []ImageManifestDisk `json:"disks"`
+}
+
+// ImageManifestDisk describes a single disk image file.
+type ImageManifestDisk struct {
+	Device string `json:"device"`
+	File   string `json:"file"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewImageBuildSpec parses the arguments of the build-image command.
+func NewImageBuildSpec(args []string) (*ImageBuildSpec, error) {
+	spec := &ImageBuildSpec{}
+	fs := flag.NewFlagSet("build-image", flag.ContinueOnError)
+	fs.StringVar(&spec.Layout, "layout", "", "path to the filesystemlayout in json format")
+	fs.StringVar(&spec.ImageURL, "image", "", "url of the os image to install")
+	fs.StringVar(&spec.OutputDir, "output", ".", "directory where disk images and manifest are written to")
+	fs.Int64Var(&spec.DiskSize, "size", 10240, "size of every disk image in MiB")
+	fs.StringVar(&spec.Format, "format", "raw", "format of the disk images, either raw or qcow2")
+	fs.StringVar(&spec.Hostname, "hostname", "metal", "hostname of the installed os")
+	fs.StringVar(&spec.MachineUUID, "machine-uuid", "00000000-0000-0000-0000-000000000000", "machine uuid of the installed os")
+	fs.StringVar(&spec.Console, "console", "ttyS0", "console of the installed os")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Layout == "" || spec.ImageURL == "" {
+		return nil, fmt.Errorf("layout and image are required")
+	}
+	if spec.Console == "" {
+		return nil, fmt.Errorf("console must not be empty")
+	}
+	if spec.Format != "raw" && spec.Format != "qcow2" {
+		return nil, fmt.Errorf("unsupported disk image format:%s", spec.Format)
+	}
+	return spec, nil
+}
+
+// BuildDiskImages runs the whole installation against sparse image files attached as loop devices
+// and writes the resulting disk images together with a manifest to the output directory.
+func BuildDiskImages(spec *ImageBuildSpec) error {
+	content, err := os.ReadFile(spec.Layout)
+	if err != nil {
+		return fmt.Errorf("unable to read filesystemlayout %w", err)
+	}
+	layout := &models.ModelsV1FilesystemLayoutResponse{}
+	err = json.Unmarshal(content, layout)
+	if err != nil {
+		return fmt.Errorf("unable to parse filesystemlayout %w", err)
+	}
+
+	err = os.MkdirAll(spec.OutputDir, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create output directory %w", err)
+	}
+
+	disks := []ImageManifestDisk{}
+	devices := make(map[string]string)
+	loops := []string{}
+	// loop devices must be detached before the disk images are converted and checksummed,
+	// this is done explicitly on success and deferred on every error.
+	detach := func() {
+		for _, loop := range loops {
+			err := storage.DetachLoopDevice(loop)
+			if err != nil {
+				log.Error("build-image", "error", err)
+			}
+		}
+		loops = nil
+	}
+	defer detach()
+	for _, disk := range layout.Disks {
+		if disk.Device == nil {
+			continue
+		}
+		file := filepath.Join(spec.OutputDir, filepath.Base(*disk.Device)+".raw")
+		err = storage.CreateImageFile(file, spec.DiskSize*1024*1024)
+		if err != nil {
+			return err
+		}
+		loop, err := storage.AttachLoopDevice(file)
+		if err != nil {
+			return err
+		}
+		loops = append(loops, loop)
+		devices[*disk.Device] = loop
+		disks = append(disks, ImageManifestDisk{Device: *disk.Device, File: file, Format: "raw"})
+	}
+	storage.RemapDevices(layout, devices)
+
+	chroot, err := os.MkdirTemp("", "metal-hammer-rootfs")
+	if err != nil {
+		return fmt.Errorf("unable to create chroot directory %w", err)
+	}
+	defer os.RemoveAll(chroot)
+
+	hammer := &Hammer{
+		Spec: &Specification{
+			DevMode:     true,
+			MachineUUID: spec.MachineUUID,
+			ImageURL:    spec.ImageURL,
+			Console:     spec.Console,
+		},
+		ChrootPrefix:     chroot,
+		FilesystemLayout: layout,
+	}
+	machine := &models.ModelsV1MachineResponse{
+		Allocation: &models.ModelsV1MachineAllocation{
+			Hostname: &spec.Hostname,
+			Image: &models.ModelsV1ImageResponse{
+				URL: spec.ImageURL,
+			},
+		},
+	}
+
+	info, err := hammer.Install(machine, nil)
+	if err != nil {
+		return fmt.Errorf("install into disk images failed %w", err)
+	}
+
+	detach()
+
+	for i := range disks {
+		if spec.Format != disks[i].Format {
+			disks[i].File, err = storage.ConvertImageFile(disks[i].File, spec.Format)
+			if err != nil {
+				return err
+			}
+			disks[i].Format = spec.Format
+		}
+		disks[i].Size, disks[i].SHA256, err = fileChecksum(disks[i].File)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest := &ImageManifest{
+		ImageURL:  spec.ImageURL,
+		Created:   time.Now().Format(time.RFC3339),
+		Version:   v.V.String(),
+		Bootinfo:  info,
+		DiskFiles: disks,
+	}
+	if layout.ID != nil {
+		manifest.LayoutID = *layout.ID
+	}
+	j, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal manifest %w", err)
+	}
+	destination := filepath.Join(spec.OutputDir, "manifest.json")
+	log.Info("write disk image manifest", "path", destination)
+	return os.WriteFile(destination, j, 0600)
+}
+
+func fileChecksum(file string) (int64, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to open %s %w", file, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to calculate sha256 of %s %w", file, err)
+	}
+	return size, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/metal-stack/metal-hammer/cmd/utils"
 
 	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/cmd/event"
 	img "github.com/metal-stack/metal-hammer/cmd/image"
 	"github.com/metal-stack/metal-hammer/cmd/storage"
 	"github.com/metal-stack/metal-hammer/metal-core/models"
@@ -42,29 +43,108 @@ type InstallerConfig struct {
 	Timestamp string `yaml:"timestamp"`
 	// Nics are the network interfaces of this machine including their neighbors.
 	Nics []*models.ModelsV1MachineNicExtended `yaml:"nics"`
+	// RaidArrays are the mdadm arrays created by the filesystemlayout, required to regenerate the initramfs.
+	RaidArrays []storage.RaidArray `yaml:"raidarrays"`
+	// RootSlot is the root slot of a layout with A/B root slots the os is installed into,
+	// the bootloader entry should be specific to the slot.
+	RootSlot string `yaml:"rootslot,omitempty"`
 }
 
-// Install a given image to the disk by using genuinetools/img
+// Install a given image, either a tarball served over http or an image in an oci registry, to the disk.
+// If the layout contains a raw image, the image is a raw disk image which is written to the disk of the layout.
+// Images which are stored in the image cache of the layout are not pulled again.
+// The overlays of the allocation are extracted on top of the image before install.sh runs.
 func (h *Hammer) Install(machine *models.ModelsV1MachineResponse, nics []*models.ModelsV1MachineNicExtended) (*kernel.Bootinfo, error) {
-	s := storage.New(h.ChrootPrefix, *h.FilesystemLayout)
-	err := s.Run()
+	s := storage.New(h.ChrootPrefix, h.Spec.MachineUUID, *h.FilesystemLayout)
+	err := s.PrepareRootSlot()
 	if err != nil {
 		return nil, err
 	}
+	h.fallbackBootinfo = s.FallbackBootinfo()
 
 	image := machine.Allocation.Image.URL
 
-	err = img.Pull(image, h.OsImageDestination)
+	keys, err := img.LoadPublicKeys(img.KeyDir)
 	if err != nil {
 		return nil, err
 	}
+	policy := img.Policy{Keys: keys, RequireSignature: h.Spec.ImageSignatureRequired}
+	mirrors := append(append([]string{}, machine.Allocation.Image.Mirrors...), h.Spec.ImageMirrors...)
+	downloader, err := img.NewDownloader(mirrors, h.Spec.ImageCABundle)
+	if err != nil {
+		return nil, err
+	}
+	if h.imageCache != nil {
+		h.imageCache.Stop(image)
+		downloader.UseCache(h.imageCache, func(image string, hit bool) {
+			if hit {
+				h.EventEmitter.Emit(event.ProvisioningEventInstalling, fmt.Sprintf("image cache hit: %s", image))
+			} else {
+				h.EventEmitter.Emit(event.ProvisioningEventInstalling, fmt.Sprintf("image cache miss: %s", image))
+			}
+		})
+	}
+
+	// a raw image brings its own partitions and filesystems, they are mounted by Run afterwards
+	rawDevice, err := s.RawImageDevice()
+	if err != nil {
+		return nil, err
+	}
+	if rawDevice != "" {
+		h.imageLayers, err = downloader.BurnRaw(rawDevice, image, policy)
+		if err != nil {
+			return nil, err
+		}
+		err = s.ExpandRawImage()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	err = img.Burn(h.ChrootPrefix, image, h.OsImageDestination)
+	err = s.Run()
 	if err != nil {
 		return nil, err
 	}
 
-	info, err := h.install(h.ChrootPrefix, machine, nics)
+	// raw images are written before the image cache is created by Run, they are always pulled
+	cached, err := s.MountImageCache(img.PersistentCacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		cache, err := img.OpenPersistentCache(img.PersistentCacheDir)
+		if err != nil {
+			log.Warn("image cache of the layout is not used", "error", err)
+		} else {
+			downloader.UsePersistentCache(cache)
+		}
+	}
+
+	if rawDevice == "" {
+		h.imageLayers, err = downloader.Burn(h.ChrootPrefix, image, machine.Allocation.ImageOverlays, policy)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the filesystems of the raw image are mounted by Run, the overlays are extracted on top of them
+		overlays, err := downloader.BurnOverlays(h.ChrootPrefix, machine.Allocation.ImageOverlays, policy)
+		if err != nil {
+			return nil, err
+		}
+		h.imageLayers = append(h.imageLayers, overlays...)
+	}
+
+	err = s.CreateRaidConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.CreateZFSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := h.install(h.ChrootPrefix, machine, nics, s)
 	if err != nil {
 		return nil, err
 	}
@@ -76,17 +156,36 @@ func (h *Hammer) Install(machine *models.ModelsV1MachineResponse, nics []*models
 		return nil, err
 	}
 
-	s.Umount()
+	err = s.CommitRootSlot()
+	if err != nil {
+		return nil, err
+	}
+
+	h.storageTopology, err = s.CreateStorageJSON()
+	if err != nil {
+		return nil, fmt.Errorf("storage.json creation failed %w", err)
+	}
+
+	err = s.CreateVerity()
+	if err != nil {
+		return nil, fmt.Errorf("create dm-verity failed %w", err)
+	}
+
+	err = s.Quiesce()
+	if err != nil {
+		return nil, fmt.Errorf("quiesce storage failed %w", err)
+	}
+	info.Cmdline = s.KernelCmdline(info.Cmdline)
 
 	return info, nil
 }
 
 // install will execute /install.sh in the pulled docker image which was extracted onto disk
 // to finish installation e.g. install mbr, grub, write network and filesystem config
-func (h *Hammer) install(prefix string, machine *models.ModelsV1MachineResponse, nics []*models.ModelsV1MachineNicExtended) (*kernel.Bootinfo, error) {
+func (h *Hammer) install(prefix string, machine *models.ModelsV1MachineResponse, nics []*models.ModelsV1MachineNicExtended, s *storage.Filesystem) (*kernel.Bootinfo, error) {
 	log.Info("install", "image", machine.Allocation.Image.URL)
 
-	err := h.writeInstallerConfig(machine, nics)
+	err := h.writeInstallerConfig(machine, nics, s)
 	if err != nil {
 		return nil, fmt.Errorf("writing configuration install.yaml failed %w", err)
 	}
@@ -210,7 +309,7 @@ func (h *Hammer) writeUserData(machine *models.ModelsV1MachineResponse) error {
 	return nil
 }
 
-func (h *Hammer) writeInstallerConfig(machine *models.ModelsV1MachineResponse, nics []*models.ModelsV1MachineNicExtended) error {
+func (h *Hammer) writeInstallerConfig(machine *models.ModelsV1MachineResponse, nics []*models.ModelsV1MachineNicExtended, s *storage.Filesystem) error {
 	log.Info("write installation configuration")
 	configdir := path.Join(h.ChrootPrefix, "etc", "metal")
 	err := os.MkdirAll(configdir, 0755)
@@ -222,14 +321,17 @@ func (h *Hammer) writeInstallerConfig(machine *models.ModelsV1MachineResponse, n
 	alloc := machine.Allocation
 
 	sshPubkeys := strings.Join(alloc.SSHPubKeys, "\n")
-	cmdline, err := kernel.ParseCmdline()
-	if err != nil {
-		return fmt.Errorf("unable to get kernel cmdline map %w", err)
-	}
-
-	console, ok := cmdline["console"]
-	if !ok {
-		console = "ttyS0"
+	console := h.Spec.Console
+	if console == "" {
+		cmdline, err := kernel.ParseCmdline()
+		if err != nil {
+			return fmt.Errorf("unable to get kernel cmdline map %w", err)
+		}
+		var ok bool
+		console, ok = cmdline["console"]
+		if !ok {
+			console = "ttyS0"
+		}
 	}
 
 	y := &InstallerConfig{
@@ -242,6 +344,8 @@ func (h *Hammer) writeInstallerConfig(machine *models.ModelsV1MachineResponse, n
 		Console:      console,
 		Timestamp:    time.Now().Format(time.RFC3339),
 		Nics:         nicsWithNeighbors(nics),
+		RaidArrays:   s.RaidArrays(),
+		RootSlot:     s.RootSlot(),
 	}
 	yamlContent, err := yaml.Marshal(y)
 	if err != nil {
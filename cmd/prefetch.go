@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	log "github.com/inconshreveable/log15"
+	img "github.com/metal-stack/metal-hammer/cmd/image"
+	"github.com/metal-stack/metal-hammer/metal-core/client/machine"
+	"golang.org/x/sys/unix"
+)
+
+// prefetchImages starts to pull the images which are likely to be installed into the image cache,
+// the machine can sit in WaitForAllocation for days. Failures are logged only, the image is pulled during
+// installation then.
+func (h *Hammer) prefetchImages() {
+	if !h.Spec.ImagePrefetch {
+		return
+	}
+	params := machine.NewPrefetchImagesParams()
+	params.SetID(h.Spec.MachineUUID)
+	resp, err := h.Client.PrefetchImages(params)
+	if err != nil {
+		log.Warn("unable to fetch the images to prefetch", "error", err)
+		return
+	}
+
+	images := []string{}
+	mirrors := append([]string{}, h.Spec.ImageMirrors...)
+	for _, i := range resp.Payload {
+		if i == nil || i.URL == "" {
+			continue
+		}
+		images = append(images, i.URL)
+		// mirrors which do not serve an image are skipped by the download
+		mirrors = append(mirrors, i.Mirrors...)
+	}
+	if len(images) == 0 {
+		return
+	}
+
+	keys, err := img.LoadPublicKeys(img.KeyDir)
+	if err != nil {
+		log.Warn("unable to prefetch images", "error", err)
+		return
+	}
+	downloader, err := img.NewDownloader(mirrors, h.Spec.ImageCABundle)
+	if err != nil {
+		log.Warn("unable to prefetch images", "error", err)
+		return
+	}
+	size := cacheSize()
+	cache, err := img.NewCache(img.CacheDir, size)
+	if err != nil {
+		log.Warn("unable to prefetch images", "error", err)
+		return
+	}
+	log.Info("prefetch images", "images", images, "cache size", size)
+	cache.Prefetch(downloader, images, img.Policy{Keys: keys, RequireSignature: h.Spec.ImageSignatureRequired})
+	h.imageCache = cache
+}
+
+// cacheSize returns the size of the image cache, which is located in memory, as half of the free memory.
+func cacheSize() int64 {
+	var info unix.Sysinfo_t
+	err := unix.Sysinfo(&info)
+	if err != nil {
+		log.Warn("unable to read free memory", "error", err)
+		return 0
+	}
+	return int64(info.Freeram) * int64(info.Unit) / 2
+}
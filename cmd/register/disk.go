@@ -0,0 +1,164 @@
+package register
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/jaypipes/ghw"
+	"github.com/metal-stack/metal-hammer/cmd/health"
+	"github.com/metal-stack/metal-hammer/cmd/storage"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+var (
+	diskByID   = "/dev/disk/by-id"
+	diskByPath = "/dev/disk/by-path"
+	sysBlock   = "/sys/block"
+)
+
+// ghw reports this value for every property it was not able to detect
+const unknown = "unknown"
+
+// readBlockDevices returns all disks of this machine with all details ghw and sysfs know about.
+func readBlockDevices() ([]*models.ModelsV1MachineBlockDevice, error) {
+	blockInfo, err := ghw.Block()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get system block devices %w", err)
+	}
+
+	byID := diskLinks(diskByID)
+	byPath := diskLinks(diskByPath)
+
+	result := []*models.ModelsV1MachineBlockDevice{}
+	for _, disk := range blockInfo.Disks {
+		if strings.HasPrefix(disk.Name, storage.DiskPrefixToIgnore) {
+			continue
+		}
+		size := int64(disk.SizeBytes)
+		diskName := disk.Name
+		if !strings.HasPrefix(diskName, "/dev/") {
+			diskName = fmt.Sprintf("/dev/%s", disk.Name)
+		}
+		blockDevice := &models.ModelsV1MachineBlockDevice{
+			Name:              &diskName,
+			Size:              &size,
+			Model:             known(disk.Model),
+			Serial:            known(disk.SerialNumber),
+			Wwn:               known(disk.WWN),
+			Vendor:            known(disk.Vendor),
+			Rotational:        disk.DriveType == ghw.DRIVE_TYPE_HDD,
+			StorageController: disk.StorageController.String(),
+			PhysicalBlockSize: int64(disk.PhysicalBlockSizeBytes),
+			ByID:              byID[disk.Name],
+			ByPath:            byPath[disk.Name],
+			Nvme:              nvmeNamespace(disk.Name),
+			Health:            diskHealth(diskName),
+		}
+		for _, p := range disk.Partitions {
+			name := p.Name
+			psize := int64(p.SizeBytes)
+			blockDevice.Partitions = append(blockDevice.Partitions, &models.ModelsV1MachineBlockDevicePartition{
+				Name:  &name,
+				Size:  &psize,
+				Label: known(p.Label),
+				Type:  known(p.Type),
+				UUID:  known(p.UUID),
+			})
+		}
+		log.Info("register", "disk", diskName, "size", size, "model", blockDevice.Model, "serial", blockDevice.Serial)
+		result = append(result, blockDevice)
+	}
+	return result, nil
+}
+
+// diskHealth returns the smart health assessment of the given disk,
+// nil is returned if the disk does not provide smart data, e.g. virtual disks.
+func diskHealth(device string) *models.ModelsV1MachineDiskHealth {
+	a, err := health.Check(device)
+	if err != nil {
+		log.Warn("register", "unable to check disk health", "disk", device, "error", err)
+		return nil
+	}
+	if a == nil {
+		return nil
+	}
+	return &models.ModelsV1MachineDiskHealth{
+		Healthy:              &a.Healthy,
+		SelfAssessmentPassed: a.SelfAssessmentPassed,
+		ReallocatedSectors:   a.ReallocatedSectors,
+		PendingSectors:       a.PendingSectors,
+		UncorrectableSectors: a.UncorrectableSectors,
+		MediaErrors:          a.MediaErrors,
+		PercentageUsed:       a.PercentageUsed,
+		CriticalWarning:      a.CriticalWarning,
+		Reasons:              a.Reasons,
+	}
+}
+
+// diskLinks returns all symlinks in the given directory, e.g. /dev/disk/by-id,
+// grouped by the name of the device they point to.
+// Links to partitions are included and can be distinguished by their device name.
+func diskLinks(dir string) map[string][]string {
+	result := make(map[string][]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Warn("register", "unable to read disk links", "dir", dir, "error", err)
+		return result
+	}
+	for _, e := range entries {
+		link := filepath.Join(dir, e.Name())
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		device := filepath.Base(target)
+		result[device] = append(result[device], link)
+	}
+	for device := range result {
+		sort.Strings(result[device])
+	}
+	return result
+}
+
+// nvmeNamespace reads the namespace identifiers of a nvme disk from sysfs,
+// nil is returned for all other disks.
+func nvmeNamespace(name string) *models.ModelsV1MachineNvmeNamespace {
+	if !strings.HasPrefix(name, "nvme") {
+		return nil
+	}
+	nsidContent := readSysBlock(name, "nsid")
+	if nsidContent == "" {
+		return nil
+	}
+	nsid, err := strconv.ParseInt(nsidContent, 10, 64)
+	if err != nil {
+		log.Warn("register", "unable to parse nvme namespace id", "disk", name, "error", err)
+		return nil
+	}
+	return &models.ModelsV1MachineNvmeNamespace{
+		Nsid:  &nsid,
+		Eui64: readSysBlock(name, "eui"),
+		Nguid: readSysBlock(name, "nguid"),
+		Wwid:  readSysBlock(name, "wwid"),
+	}
+}
+
+func readSysBlock(name, attribute string) string {
+	content, err := os.ReadFile(filepath.Join(sysBlock, name, attribute))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func known(value string) string {
+	if value == unknown {
+		return ""
+	}
+	return value
+}
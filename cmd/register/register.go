@@ -13,7 +13,6 @@ import (
 	"github.com/metal-stack/go-hal"
 	"github.com/metal-stack/go-hal/pkg/api"
 	"github.com/metal-stack/metal-hammer/cmd/network"
-	"github.com/metal-stack/metal-hammer/cmd/storage"
 	"github.com/metal-stack/metal-hammer/metal-core/client/machine"
 	"github.com/metal-stack/metal-hammer/metal-core/models"
 	"github.com/vishvananda/netlink"
@@ -127,25 +126,11 @@ func (r *Register) ReadHardwareDetails() (*models.DomainMetalHammerRegisterMachi
 	hw.Nics = nics
 	hw.UUID = r.MachineUUID
 
-	blockInfo, err := ghw.Block()
+	disks, err := readBlockDevices()
 	if err != nil {
-		return nil, fmt.Errorf("unable to get system block devices %w", err)
-	}
-	for _, disk := range blockInfo.Disks {
-		if strings.HasPrefix(disk.Name, storage.DiskPrefixToIgnore) {
-			continue
-		}
-		size := int64(disk.SizeBytes)
-		diskName := disk.Name
-		if !strings.HasPrefix(diskName, "/dev/") {
-			diskName = fmt.Sprintf("/dev/%s", disk.Name)
-		}
-		blockDevice := &models.ModelsV1MachineBlockDevice{
-			Name: &diskName,
-			Size: &size,
-		}
-		hw.Disks = append(hw.Disks, blockDevice)
+		return nil, err
 	}
+	hw.Disks = disks
 
 	ipmiconfig, err := readIPMIDetails(r.Network.Eth0Mac, r.Hal)
 	if err != nil {
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -151,3 +152,37 @@ func TestUUIDCreation(t *testing.T) {
 		t.Errorf("expected same uuid, got different: %s vs: %s", uuidAsString, uuidAsString2)
 	}
 }
+
+func Test_diskLinks(t *testing.T) {
+	dir := t.TempDir()
+	links := map[string]string{
+		"ata-SAMSUNG_MZ7LH480_S45NNA0M123456":       "../../sda",
+		"ata-SAMSUNG_MZ7LH480_S45NNA0M123456-part1": "../../sda1",
+		"wwn-0x5002538e40a1b2c3":                    "../../sda",
+		"nvme-eui.0025388b71b2c3d4":                 "../../nvme0n1",
+	}
+	for name, target := range links {
+		err := os.Symlink(target, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := diskLinks(dir)
+	want := map[string][]string{
+		"sda": {
+			filepath.Join(dir, "ata-SAMSUNG_MZ7LH480_S45NNA0M123456"),
+			filepath.Join(dir, "wwn-0x5002538e40a1b2c3"),
+		},
+		"sda1":    {filepath.Join(dir, "ata-SAMSUNG_MZ7LH480_S45NNA0M123456-part1")},
+		"nvme0n1": {filepath.Join(dir, "nvme-eui.0025388b71b2c3d4")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diskLinks() = %v, want %v", got, want)
+	}
+
+	got = diskLinks(filepath.Join(dir, "notexisting"))
+	if len(got) != 0 {
+		t.Errorf("diskLinks() of missing dir = %v, want empty", got)
+	}
+}
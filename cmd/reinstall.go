@@ -38,7 +38,14 @@ func (h *Hammer) abortReinstall(reason error, machineID string, primaryDiskWiped
 		time.Sleep(5 * time.Second)
 	}
 
-	if resp != nil && resp.Payload != nil {
+	if h.fallbackBootinfo != nil {
+		log.Info("boot into active root slot", "slot", h.fallbackBootinfo.Slot)
+		bootInfo = h.fallbackBootinfo
+		err = h.EnsureBootOrder(bootInfo.BootloaderID)
+		if err != nil {
+			log.Error("unable to ensure boot order of active root slot", "error", err)
+		}
+	} else if resp != nil && resp.Payload != nil {
 		bootInfo = &kernel.Bootinfo{
 			Initrd:       *resp.Payload.Initrd,
 			Cmdline:      *resp.Payload.Cmdline,
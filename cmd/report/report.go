@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	log "github.com/inconshreveable/log15"
+	img "github.com/metal-stack/metal-hammer/cmd/image"
+	"github.com/metal-stack/metal-hammer/cmd/storage"
 	"github.com/metal-stack/metal-hammer/metal-core/client/machine"
 	"github.com/metal-stack/metal-hammer/metal-core/models"
 )
@@ -17,6 +19,10 @@ type Report struct {
 	Cmdline         string
 	Kernel          string
 	BootloaderID    string
+	// Storage is the storage topology of the installed machine
+	Storage *storage.Topology
+	// ImageLayers are the digests of the installed image and its overlays
+	ImageLayers []img.Layer
 }
 
 // ReportInstallation will tell metal-core the result of the installation
@@ -29,6 +35,12 @@ func (r *Report) ReportInstallation() error {
 		Kernel:          &r.Kernel,
 		Bootloaderid:    &r.BootloaderID,
 	}
+	if r.Storage != nil {
+		report.Storage = r.Storage
+	}
+	for _, layer := range r.ImageLayers {
+		report.ImageLayers = append(report.ImageLayers, &models.DomainImageLayer{URL: layer.URL, Digest: layer.Digest})
+	}
 	if r.InstallError != nil {
 		message := r.InstallError.Error()
 		report.Success = false
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	img "github.com/metal-stack/metal-hammer/cmd/image"
 	"github.com/metal-stack/metal-hammer/metal-core/client/machine"
 	"github.com/metal-stack/metal-hammer/metal-core/models"
 
@@ -40,6 +41,7 @@ func TestReportInstallation(t *testing.T) {
 	r := &Report{
 		Client:       client,
 		InstallError: errors.New("an error occurred"),
+		ImageLayers:  []img.Layer{{URL: "http://images.metal-stack.io/ubuntu.tar.lz4", Digest: "sha256:0123"}},
 	}
 
 	err := r.ReportInstallation()
@@ -53,4 +55,7 @@ func TestReportInstallation(t *testing.T) {
 	if resp.Success {
 		t.Errorf("response success:%t expected:False", resp.Success)
 	}
+	if len(resp.ImageLayers) != 1 || resp.ImageLayers[0].Digest != "sha256:0123" {
+		t.Errorf("response image layers:%v expected the digest of the image", resp.ImageLayers)
+	}
 }
@@ -9,6 +9,7 @@ import (
 	log "github.com/inconshreveable/log15"
 	"github.com/metal-stack/go-hal"
 	"github.com/metal-stack/metal-hammer/cmd/event"
+	img "github.com/metal-stack/metal-hammer/cmd/image"
 	"github.com/metal-stack/metal-hammer/cmd/network"
 	"github.com/metal-stack/metal-hammer/cmd/register"
 	"github.com/metal-stack/metal-hammer/cmd/report"
@@ -33,10 +34,17 @@ type Hammer struct {
 	LLDPClient       *network.LLDPClient
 	FilesystemLayout *models.ModelsV1FilesystemLayoutResponse
 	// IPAddress is the ip of the eth0 interface during installation
-	IPAddress          string
-	Started            time.Time
-	ChrootPrefix       string
-	OsImageDestination string
+	IPAddress    string
+	Started      time.Time
+	ChrootPrefix string
+	// fallbackBootinfo of the active root slot which is booted if a reinstallation fails
+	fallbackBootinfo *kernel.Bootinfo
+	// storageTopology of the installed machine which is reported to metal-core
+	storageTopology *storage.Topology
+	// imageCache contains the images which were prefetched while waiting for the allocation
+	imageCache *img.Cache
+	// imageLayers are the digests of the installed image and its overlays which are reported to metal-core
+	imageLayers []img.Layer
 }
 
 // Run orchestrates the whole register/wipe/format/burn and reboot process
@@ -56,13 +64,12 @@ func Run(spec *Specification, hal hal.InBand) (*event.EventEmitter, error) {
 	}
 
 	hammer := &Hammer{
-		Hal:                hal,
-		Client:             client,
-		Spec:               spec,
-		IPAddress:          spec.IP,
-		EventEmitter:       eventEmitter,
-		ChrootPrefix:       "/rootfs",
-		OsImageDestination: "/tmp/os.tgz",
+		Hal:          hal,
+		Client:       client,
+		Spec:         spec,
+		IPAddress:    spec.IP,
+		EventEmitter: eventEmitter,
+		ChrootPrefix: "/rootfs",
 	}
 
 	// Reboot after 24Hours if no allocation was requested.
@@ -132,8 +139,12 @@ func Run(spec *Specification, hal hal.InBand) (*event.EventEmitter, error) {
 			err = fmt.Errorf("no image specified")
 		} else {
 			log.Info("perform reinstall", "machineID", *m.ID, "imageID", *m.Allocation.Image.ID)
-			err = hammer.installImage(eventEmitter, m, hw.Nics)
-			primaryDiskWiped = true
+			err = hammer.ensureDisksHealthy(hw.Disks)
+			if err == nil {
+				err = hammer.installImage(eventEmitter, m, hw.Nics)
+				// the active root slot is kept during installation into the inactive slot
+				primaryDiskWiped = hammer.fallbackBootinfo == nil
+			}
 		}
 		if err != nil {
 			log.Error("reinstall failed", "error", err)
@@ -142,6 +153,13 @@ func Run(spec *Specification, hal hal.InBand) (*event.EventEmitter, error) {
 		return eventEmitter, err
 	}
 
+	// Refuse to install onto failing disks, the machine will not become available for allocation
+	// until the disks are replaced.
+	err = hammer.ensureDisksHealthy(hw.Disks)
+	if err != nil {
+		return eventEmitter, fmt.Errorf("disk health %w", err)
+	}
+
 	err = storage.WipeDisks()
 	if err != nil {
 		return eventEmitter, fmt.Errorf("wipe %w", err)
@@ -232,6 +250,7 @@ func Run(spec *Specification, hal hal.InBand) (*event.EventEmitter, error) {
 			},
 		}
 	} else {
+		hammer.prefetchImages()
 		err := hammer.GrpcClient.WaitForAllocation(spec.MachineUUID)
 		if err != nil {
 			return eventEmitter, fmt.Errorf("wait for installation %w", err)
@@ -267,6 +286,8 @@ func (h *Hammer) installImage(eventEmitter *event.EventEmitter, m *models.Models
 		Cmdline:         info.Cmdline,
 		Kernel:          info.Kernel,
 		BootloaderID:    info.BootloaderID,
+		Storage:         h.storageTopology,
+		ImageLayers:     h.imageLayers,
 		InstallError:    err,
 	}
 
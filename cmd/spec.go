@@ -35,10 +35,22 @@ type Specification struct {
 	Cidr string
 	// ConsolePassword of the metal user valid for one day.
 	ConsolePassword string
+	// Console of the installed os, taken from the kernel command line if empty
+	Console string
 	// MachineUUID is the unique identifier of this machine
 	MachineUUID string
 	// IP of this instance
 	IP string
+	// ImageSignatureRequired refuses to install images which are not signed by a trusted key,
+	// required unless in DevMode or disabled with IMAGE_SIGNATURE=optional, the trusted keys are part of the initrd
+	ImageSignatureRequired bool
+	// ImageMirrors are base urls of mirrors which serve the images under the same path
+	ImageMirrors []string
+	// ImageCABundle is a file with additional ca certificates which are trusted for image downloads
+	ImageCABundle string
+	// ImagePrefetch pulls the images which are likely to be installed while waiting for the allocation,
+	// enabled unless in DevMode or disabled with IMAGE_PREFETCH=false
+	ImagePrefetch bool
 }
 
 // NewSpec fills Specification with configuration made by kernel commandline
@@ -88,6 +100,45 @@ func NewSpec() *Specification {
 		}
 	}
 
+	if m, ok := envmap["IMAGE_MIRRORS"]; ok {
+		for _, mirror := range strings.Split(m, ",") {
+			if mirror != "" {
+				spec.ImageMirrors = append(spec.ImageMirrors, mirror)
+			}
+		}
+	}
+
+	if c, ok := envmap["IMAGE_CA_BUNDLE"]; ok {
+		spec.ImageCABundle = c
+	}
+
+	// proxies are taken from the environment for all http requests
+	for _, proxy := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		if p, ok := envmap[proxy]; ok {
+			os.Setenv(proxy, p)
+		}
+	}
+
+	spec.ImageSignatureRequired = !spec.DevMode
+	if s, ok := envmap["IMAGE_SIGNATURE"]; ok {
+		switch strings.ToLower(s) {
+		case "required":
+			spec.ImageSignatureRequired = true
+		case "optional":
+			spec.ImageSignatureRequired = false
+		default:
+			log.Warn("ignore unknown image signature policy", "policy", s)
+		}
+	}
+
+	spec.ImagePrefetch = !spec.DevMode
+	if p, ok := envmap["IMAGE_PREFETCH"]; ok {
+		enabled, err := strconv.ParseBool(p)
+		if err == nil {
+			spec.ImagePrefetch = enabled
+		}
+	}
+
 	return spec
 }
 
@@ -104,5 +155,9 @@ func (s *Specification) Log() {
 		"cidr", s.Cidr,
 		"machineUUID", s.MachineUUID,
 		"ip", s.IP,
+		"imageSignatureRequired", s.ImageSignatureRequired,
+		"imageMirrors", s.ImageMirrors,
+		"imageCABundle", s.ImageCABundle,
+		"imagePrefetch", s.ImagePrefetch,
 	)
 }
@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"encoding/json"
 	"fmt"
 	gos "os"
 	"os/exec"
@@ -9,10 +8,10 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-	"syscall"
 
 	log "github.com/inconshreveable/log15"
 	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/kernel"
 	"github.com/metal-stack/metal-hammer/pkg/os"
 	"github.com/metal-stack/metal-hammer/pkg/os/command"
 	"github.com/metal-stack/v"
@@ -22,12 +21,25 @@ type Filesystem struct {
 	config models.ModelsV1FilesystemLayoutResponse
 	// chroot defines the root of the mounts
 	chroot string
+	// machineUUID is used to derive deterministic uuids
+	machineUUID string
 	// mounts are collected to be able to umount all in reverse order
 	mounts       []string
 	fstabEntries fstabEntries
-	// disk is the legacy disk.json representatio
-	// TODO remove once old images are gone
-	disk Disk
+	// raidArrays are collected to be able to write mdadm.conf
+	raidArrays []RaidArray
+	// zpools are collected to be able to export them before kexec
+	zpools []string
+	// verity of the root filesystem, required for the kernel command line
+	verity *Verity
+	// targetSlot is the root slot the os is installed into
+	targetSlot string
+	// preserve is set if another root slot is active, its partitions, raids, volumes and filesystems must be kept
+	preserve bool
+	// fallback is the boot information of the active root slot
+	fallback *kernel.Bootinfo
+	// created are all resources created by Run, they are removed if Run fails
+	created []resource
 }
 
 type fstabEntries []fstabEntry
@@ -42,30 +54,64 @@ type fstabEntry struct {
 	passno    uint
 }
 
-func New(chroot string, config models.ModelsV1FilesystemLayoutResponse) *Filesystem {
+func New(chroot, machineUUID string, config models.ModelsV1FilesystemLayoutResponse) *Filesystem {
 	return &Filesystem{
 		config:       config,
 		chroot:       chroot,
+		machineUUID:  machineUUID,
 		fstabEntries: fstabEntries{},
-		disk:         Disk{Device: "legacy", Partitions: []Partition{}},
 	}
 }
 
+// Run creates the storage layout and mounts all filesystems below the chroot. If any step fails,
+// everything created so far is removed again in reverse order and listed in the returned error.
 func (f *Filesystem) Run() error {
-
-	err := f.createPartitions()
+	err := f.run()
 	if err != nil {
-		return fmt.Errorf("create partitions failed:%w", err)
+		return f.rollbackError(err)
 	}
+	return nil
+}
 
-	err = f.createRaids()
+func (f *Filesystem) run() error {
+	_, err := verityFilesystem(f.config)
 	if err != nil {
-		return fmt.Errorf("create raids failed:%w", err)
+		return err
 	}
-
-	err = f.createLogicalVolumes()
+	err = validateImageCache(f.config)
 	if err != nil {
-		return fmt.Errorf("create logical volumes failed:%w", err)
+		return err
+	}
+	err = checkZFS(f.config)
+	if err != nil {
+		return err
+	}
+
+	if f.preserve {
+		log.Info("keep existing storage of the active root slot")
+		err = f.readRaidArrays()
+		if err != nil {
+			return fmt.Errorf("read raids failed:%w", err)
+		}
+		err = f.importZPools()
+		if err != nil {
+			return fmt.Errorf("import zfs pools failed:%w", err)
+		}
+	} else {
+		err = f.createPartitions()
+		if err != nil {
+			return fmt.Errorf("create partitions failed:%w", err)
+		}
+
+		err = f.createRaids()
+		if err != nil {
+			return fmt.Errorf("create raids failed:%w", err)
+		}
+
+		err = f.createLogicalVolumes()
+		if err != nil {
+			return fmt.Errorf("create logical volumes failed:%w", err)
+		}
 	}
 
 	err = f.createFilesystems()
@@ -73,6 +119,13 @@ func (f *Filesystem) Run() error {
 		return fmt.Errorf("create filesystems failed:%w", err)
 	}
 
+	if !f.preserve {
+		err = f.createZPools()
+		if err != nil {
+			return fmt.Errorf("create zfs pools failed:%w", err)
+		}
+	}
+
 	err = f.mountFilesystems()
 	if err != nil {
 		return fmt.Errorf("mount filesystems failed:%w", err)
@@ -81,18 +134,8 @@ func (f *Filesystem) Run() error {
 	if err != nil {
 		return fmt.Errorf("mount special filesystems failed:%w", err)
 	}
-
-	// TODO legacy image support, can be removed once all images in use do no depend on disk.json anymore
-	err = f.createDiskJSON()
-	if err != nil {
-		return fmt.Errorf("disk.json creation failed:%w", err)
-	}
 	return nil
 }
-func (f *Filesystem) Umount() {
-	f.umountFilesystems()
-}
-
 func (f *Filesystem) createPartitions() error {
 	if len(f.config.Disks) == 0 {
 		return nil
@@ -103,14 +146,39 @@ func (f *Filesystem) createPartitions() error {
 		if disk.Wipeonreinstall != nil && *disk.Wipeonreinstall {
 			opts = append(opts, "--zap-all")
 		}
+		var ranges map[int64]partitionRange
+		if disk.Device != nil && needsGeometry(disk) {
+			var (
+				alignment uint64
+				err       error
+			)
+			ranges, alignment, err = calculatePartitionRanges(*disk.Device, disk)
+			if err != nil {
+				return err
+			}
+			// sgdisk must not move the already aligned partition starts
+			opts = append(opts, fmt.Sprintf("--set-alignment=%d", alignment))
+		}
+		if disk.Device != nil {
+			if guid := f.deterministicUUID("disk", *disk.Device); guid != "" {
+				opts = append(opts, "--disk-guid="+guid)
+			}
+		}
 		for _, p := range disk.Partitions {
-			if p.Size != nil {
+			if r, ok := ranges[*p.Number]; ok {
+				opts = append(opts, fmt.Sprintf("--new=%d:%d:%d", *p.Number, r.start, r.end))
+			} else if p.Size != nil {
 				opts = append(opts, fmt.Sprintf("--new=%d:0:+%dM", *p.Number, *p.Size))
 			}
 			opts = append(opts, fmt.Sprintf("--change-name=%d:%s", *p.Number, p.Label))
 			if p.Gpttype != nil {
 				opts = append(opts, fmt.Sprintf("--typecode=%d:%s", *p.Number, *p.Gpttype))
 			}
+			if disk.Device != nil {
+				if guid := f.deterministicUUID("partition", *disk.Device, fmt.Sprintf("%d", *p.Number), p.Label); guid != "" {
+					opts = append(opts, fmt.Sprintf("--partition-guid=%d:%s", *p.Number, guid))
+				}
+			}
 		}
 		if disk.Device != nil {
 			log.Info("wipe existing partition signatures", "command", command.WIPEFS+" --all"+" "+*disk.Device)
@@ -126,6 +194,7 @@ func (f *Filesystem) createPartitions() error {
 				log.Error("sgdisk creating partitions failed", "error", err)
 				return fmt.Errorf("unable to create partitions on %s %w", *disk.Device, err)
 			}
+			f.trackPartitions(*disk.Device)
 		}
 	}
 	return nil
@@ -181,6 +250,14 @@ func (f *Filesystem) createRaids() error {
 			log.Error("create mdadm raid", "error", err)
 			return fmt.Errorf("unable to create mdadm raid %s %w", *raid.Arrayname, err)
 		}
+		f.trackRaid(*raid.Arrayname, raid.Devices)
+
+		details, err := readRaidDetails(*raid.Arrayname)
+		if err != nil {
+			return err
+		}
+		log.Info("created mdadm raid", "array", details.Name, "uuid", details.UUID)
+		f.raidArrays = append(f.raidArrays, *details)
 
 		// set sync speed
 		err = gos.WriteFile("/proc/sys/dev/raid/speed_limit_min", []byte("200000000"), 0644)
@@ -196,11 +273,17 @@ func (f *Filesystem) createLogicalVolumes() error {
 		return nil
 	}
 
-	pvcount := make(map[string]int)
+	err := validateLogicalVolumes(f.config)
+	if err != nil {
+		return err
+	}
+
+	vgs := make(map[string]*models.ModelsV1VolumeGroup)
 	for _, vg := range f.config.Volumegroups {
 		if vg.Name == nil || *vg.Name == "" {
 			continue
 		}
+		vgs[*vg.Name] = vg
 		if vgExists(*vg.Name) {
 			continue
 		}
@@ -214,57 +297,43 @@ func (f *Filesystem) createLogicalVolumes() error {
 		}
 		args = append(args, vg.Devices...)
 
-		pvcount[*vg.Name] = len(vg.Devices)
 		err := os.ExecuteCommand(command.LVM, args...)
 		if err != nil {
 			log.Error("vgcreate", "error", err)
 			return fmt.Errorf("unable to create volume group %s %w", *vg.Name, err)
 		}
+		f.trackVolumeGroup(*vg.Name, vg.Devices)
 	}
 
+	// thin volumes require their thin pool and caches require both volumes to be present,
+	// therefore all other volumes are created first
+	lvs := []*models.ModelsV1LogicalVolume{}
+	thins := []*models.ModelsV1LogicalVolume{}
 	for _, lv := range f.config.Logicalvolumes {
 		if lv.Name == nil || *lv.Name == "" || lv.Volumegroup == nil || *lv.Volumegroup == "" {
 			continue
 		}
-		if lvExists(*lv.Volumegroup, *lv.Name) {
-			continue
-		}
 		if lv.Size == nil {
 			continue
 		}
-
-		args := []string{
-			"lvcreate",
-			"--verbose",
-			"--name", *lv.Name,
-			"--wipesignatures", "y",
-		}
-
-		if *lv.Size > int64(0) {
-			args = append(args, "--size", fmt.Sprintf("%dm", *lv.Size))
-		} else {
-			args = append(args, "--extents", "100%FREE")
+		if lvmType(lv) == lvmTypeThin {
+			thins = append(thins, lv)
+			continue
 		}
+		lvs = append(lvs, lv)
+	}
 
-		lvmtype := "linear"
-		if lv.Lvmtype != nil {
-			lvmtype = *lv.Lvmtype
+	existing := make(map[*models.ModelsV1LogicalVolume]bool)
+	for _, lv := range append(lvs, thins...) {
+		if lvExists(*lv.Volumegroup, *lv.Name) {
+			existing[lv] = true
+			continue
 		}
-		if pvcount[*lv.Volumegroup] < 2 {
+		pvs := pvCount(lv, vgs)
+		if pvs < 2 && effectiveLvmType(lv, pvs) != lvmType(lv) {
 			log.Warn("volumegroup has only 1 pv, only linear is supported", "lv", *lv.Name, "vg", *lv.Volumegroup)
-			lvmtype = "linear"
 		}
-
-		switch lvmtype {
-		case "linear":
-		case "striped":
-			args = append(args, "--type", "striped", "--stripes", fmt.Sprintf("%d", pvcount[*lv.Volumegroup]))
-		case "raid1":
-			args = append(args, "--type", "raid1", "--mirrors", "1", "--nosync")
-		default:
-			return fmt.Errorf("unsupported lvmtype:%s", lvmtype)
-		}
-		args = append(args, *lv.Volumegroup)
+		args := lvCreateArgs(lv, pvs)
 
 		log.Info("lvcreate", "args", args)
 		err := os.ExecuteCommand(command.LVM, args...)
@@ -272,6 +341,20 @@ func (f *Filesystem) createLogicalVolumes() error {
 			log.Error("lvcreate", "error", err)
 			return fmt.Errorf("unable to create logical volume %s %w", *lv.Name, err)
 		}
+		f.trackLogicalVolume(*lv.Volumegroup, *lv.Name)
+	}
+
+	for _, lv := range lvs {
+		if lv.Cachevolume == "" || existing[lv] {
+			continue
+		}
+		args := lvConvertCacheArgs(lv)
+		log.Info("lvconvert", "args", args)
+		err := os.ExecuteCommand(command.LVM, args...)
+		if err != nil {
+			log.Error("lvconvert", "error", err)
+			return fmt.Errorf("unable to attach cache %s to logical volume %s %w", lv.Cachevolume, *lv.Name, err)
+		}
 	}
 
 	return nil
@@ -283,32 +366,50 @@ func (f *Filesystem) createFilesystems() error {
 	}
 
 	for _, fs := range f.config.Filesystems {
-		if fs.Format == nil || *fs.Format == "tmpfs" {
+		if fs.Format == nil || *fs.Format == "tmpfs" || f.skipFilesystem(fs, true) {
 			continue
 		}
 		mkfs := ""
 		args := []string{}
 		args = append(args, fs.Createoptions...)
+		fsUUID := ""
+		if fs.Device != nil {
+			fsUUID = f.deterministicUUID("filesystem", *fs.Device, fs.Label)
+		}
 		switch *fs.Format {
 		case "ext3":
 			mkfs = command.MKFSExt3
 			args = append(args, "-F")
 			args = append(args, "-L", fs.Label)
+			if fsUUID != "" {
+				args = append(args, "-U", fsUUID)
+			}
 		case "ext4":
 			mkfs = command.MKFSExt4
 			args = append(args, "-F")
 			args = append(args, "-L", fs.Label)
+			if fsUUID != "" {
+				args = append(args, "-U", fsUUID)
+			}
 		case "swap":
 			mkfs = command.MKSwap
 			args = append(args, "-f")
 			args = append(args, "-L", fs.Label)
+			if fsUUID != "" {
+				args = append(args, "-U", fsUUID)
+			}
 		case "vfat":
 			mkfs = command.MKFSVFat
 			// There is no force flag for mkfs.vfat, it always destroys any data on
 			// the device at which it is pointed.
 			args = append(args, "-n", fs.Label)
+			if fsUUID != "" {
+				// vfat has no uuid but a 32 bit volume id
+				args = append(args, "-i", volumeID(fsUUID))
+			}
 		case "none":
-			//
+			// bind mounts have no filesystem to create
+			continue
 		default:
 			return fmt.Errorf("unsupported filesystem format: %q", *fs.Format)
 		}
@@ -319,6 +420,7 @@ func (f *Filesystem) createFilesystems() error {
 			log.Error("create filesystem failed", "device", *fs.Device, "error", err)
 			return fmt.Errorf("unable to create filesystem on %s %w", *fs.Device, err)
 		}
+		f.trackFilesystem(*fs.Device)
 	}
 
 	return nil
@@ -327,28 +429,44 @@ func (f *Filesystem) createFilesystems() error {
 func (f *Filesystem) mountFilesystems() error {
 	fss := []models.ModelsV1Filesystem{}
 	for _, fs := range f.config.Filesystems {
-		if fs.Path == "" {
+		if fs.Path == "" || (fs.Format != nil && *fs.Format == "swap") || f.skipFilesystem(fs, false) {
 			continue
 		}
 		fss = append(fss, *fs)
 	}
+	fss = append(fss, f.zfsFilesystems()...)
 	sort.Slice(fss, func(i, j int) bool { return depth(fss[i].Path) < depth(fss[j].Path) })
 	for _, fs := range fss {
+		if *fs.Format == "zfs" {
+			// zfs datasets are mounted by zfs-mount.service and need no fstab entry
+			path, err := mountZFS(f.chroot, fs)
+			if err != nil {
+				return err
+			}
+			f.mounts = append(f.mounts, path)
+			f.trackMount(path)
+			continue
+		}
 		path, err := mountFs(f.chroot, fs)
 		if err != nil {
 			return err
 		}
 		if path != "" {
 			f.mounts = append(f.mounts, path)
+			f.trackMount(path)
 		}
 
 		passno := uint(2)
 		spec := ""
 		properties := map[string]string{"UUID": ""}
-		if *fs.Format == "tmpfs" {
+		switch *fs.Format {
+		case "tmpfs":
 			spec = *fs.Format
 			passno = 0
-		} else {
+		case "none":
+			spec = *fs.Device
+			passno = 0
+		default:
 			properties, err = FetchBlockIDProperties(*fs.Device)
 			if err != nil {
 				return err
@@ -358,9 +476,20 @@ func (f *Filesystem) mountFilesystems() error {
 		if fs.Path == "/" {
 			passno = 1
 		}
+		if fs.Verity != nil {
+			// the verity device is created by the kernel and can not be checked
+			spec = verityDevice
+			passno = 0
+		}
 		mountOpts := []string{"defaults"}
 		if len(fs.Mountoptions) > 0 {
-			mountOpts = fs.Mountoptions
+			mountOpts = append([]string{}, fs.Mountoptions...)
+		}
+		if *fs.Format == "tmpfs" {
+			mountOpts = append(mountOpts, tmpfsOptions(fs)...)
+		}
+		if fs.Verity != nil {
+			mountOpts = append(mountOpts, "ro")
 		}
 		fstabEntry := fstabEntry{
 			spec:      spec,
@@ -371,36 +500,61 @@ func (f *Filesystem) mountFilesystems() error {
 			passno:    passno,
 		}
 		f.fstabEntries = append(f.fstabEntries, fstabEntry)
-		// create legacy disk.json
-		switch fs.Label {
-		case "root", "efi", "varlib":
-			part := Partition{
-				Label:      fs.Label,
-				Filesystem: *fs.Format,
-				Properties: map[string]string{"UUID": properties["UUID"]},
-			}
-			f.disk.Partitions = append(f.disk.Partitions, part)
+	}
+	return f.addSwapEntries()
+}
+
+// addSwapEntries adds all swap filesystems to fstab, they are not mounted and have no path.
+func (f *Filesystem) addSwapEntries() error {
+	for _, fs := range f.config.Filesystems {
+		if fs.Format == nil || *fs.Format != "swap" || fs.Device == nil {
+			continue
 		}
+		properties, err := FetchBlockIDProperties(*fs.Device)
+		if err != nil {
+			return err
+		}
+		f.fstabEntries = append(f.fstabEntries, swapEntry(properties["UUID"], *fs))
 	}
 	return nil
 }
 
-type mount struct {
-	source string
-	target string
-	fstype string
-	flags  uintptr
-	data   string
+func swapEntry(uuid string, fs models.ModelsV1Filesystem) fstabEntry {
+	mountOpts := []string{"sw"}
+	if len(fs.Mountoptions) > 0 {
+		mountOpts = append([]string{}, fs.Mountoptions...)
+	}
+	if fs.Swappriority > 0 {
+		mountOpts = append(mountOpts, fmt.Sprintf("pri=%d", fs.Swappriority))
+	}
+	return fstabEntry{
+		spec:      fmt.Sprintf("UUID=%s", uuid),
+		file:      "none",
+		vfsType:   "swap",
+		mountOpts: mountOpts,
+	}
+}
+
+// tmpfsOptions returns the size and mode options of a tmpfs.
+func tmpfsOptions(fs models.ModelsV1Filesystem) []string {
+	options := []string{}
+	if fs.Tmpfssize != "" {
+		options = append(options, "size="+fs.Tmpfssize)
+	}
+	if fs.Tmpfsmode != "" {
+		options = append(options, "mode="+fs.Tmpfsmode)
+	}
+	return options
 }
 
 var (
 	specialMounts = []mount{
-		{source: "proc", target: "/proc", fstype: "proc", flags: 0, data: ""},
-		{source: "sys", target: "/sys", fstype: "sysfs", flags: 0, data: ""},
-		{source: "efivarfs", target: "/sys/firmware/efi/efivars", fstype: "efivarfs", flags: 0, data: ""},
-		{source: "tmpfs", target: "/tmp", fstype: "tmpfs", flags: 0, data: ""},
+		{source: "proc", target: "/proc", fstype: "proc"},
+		{source: "sys", target: "/sys", fstype: "sysfs"},
+		{source: "efivarfs", target: "/sys/firmware/efi/efivars", fstype: "efivarfs"},
+		{source: "tmpfs", target: "/tmp", fstype: "tmpfs"},
 		// /dev and /run are bind mounts, a bind mount must have MS_BIND flags set see man 2 mount
-		{source: "/dev", target: "/dev", fstype: "", flags: syscall.MS_BIND, data: ""},
+		{source: "/dev", target: "/dev", fstype: "", options: []string{"bind"}},
 	}
 )
 
@@ -417,67 +571,49 @@ func (f *Filesystem) mountSpecialFilesystems() error {
 			return err
 		}
 
-		log.Info("mount", "source", m.source, "target", mountPoint, "fstype", m.fstype, "flags", m.flags, "data", m.data)
-		err := syscall.Mount(m.source, mountPoint, m.fstype, m.flags, m.data)
+		err := mountWithOptions(m.source, mountPoint, m.fstype, m.options)
 		if err != nil {
-			return fmt.Errorf("mounting %s to %s failed %w", m.source, m.target, err)
+			return err
 		}
+		f.trackMount(mountPoint)
 	}
 	return nil
 }
 
-func (f *Filesystem) umountFilesystems() {
-	for index := len(specialMounts) - 1; index >= 0; index-- {
-		m := filepath.Join(f.chroot, specialMounts[index].target)
-		log.Info("unmounting", "mountpoint", m)
-		err := syscall.Unmount(m, syscall.MNT_FORCE)
-		if err != nil {
-			log.Error("unable to unmount", "path", m, "error", err)
-		}
-	}
-	for index := len(f.mounts) - 1; index >= 0; index-- {
-		m := f.mounts[index]
-		if m == "" {
-			continue
-		}
-		log.Info("unmounting", "mountpoint", m)
-		err := syscall.Unmount(m, syscall.MNT_FORCE)
-		if err != nil {
-			log.Error("unable to unmount", "path", m, "error", err)
-		}
-	}
-}
-
+// CreateFSTab writes the mount configuration of the target os, either as /etc/fstab or as systemd units,
+// and the zram swap devices.
 func (f *Filesystem) CreateFSTab() error {
-	return f.fstabEntries.write(f.chroot)
-}
-
-func (f *Filesystem) createDiskJSON() error {
-	configdir := path.Join(f.chroot, "etc", "metal")
-	destination := path.Join(configdir, "disk.json")
-
-	if _, err := gos.Stat(configdir); err != nil && gos.IsNotExist(err) {
-		if err := gos.MkdirAll(configdir, 0755); err != nil {
-			return err
-		}
-	} else if err != nil {
+	err := writeZramConfig(f.chroot, f.config.Zram)
+	if err != nil {
 		return err
 	}
-
-	j, err := json.MarshalIndent(f.disk, "", "  ")
-	if err != nil {
-		return fmt.Errorf("unable to marshal to json %w", err)
+	if f.config.Mountunits {
+		return f.fstabEntries.writeUnits(f.chroot)
 	}
-	log.Info("create legacy disk.json", "content", string(j))
-	return gos.WriteFile(destination, j, 0600)
+	return f.fstabEntries.write(f.chroot)
 }
 
 func mountFs(chroot string, fs models.ModelsV1Filesystem) (string, error) {
-	if fs.Format == nil || *fs.Format == "swap" || *fs.Format == "" || *fs.Format == "tmpfs" {
+	if fs.Format == nil || *fs.Format == "swap" || *fs.Format == "" {
 		return "", nil
 	}
 	path := filepath.Join(chroot, fs.Path)
 
+	source := *fs.Device
+	fstype := *fs.Format
+	options := fs.Mountoptions
+	switch fstype {
+	case "tmpfs":
+		source = "tmpfs"
+		options = append(append([]string{}, options...), tmpfsOptions(fs)...)
+	case "none":
+		// bind mounts of directories are relative to the target os
+		fstype = ""
+		if !strings.HasPrefix(source, "/dev/") {
+			source = filepath.Join(chroot, source)
+		}
+	}
+
 	if _, err := gos.Stat(path); err != nil && gos.IsNotExist(err) {
 		if err := gos.MkdirAll(path, 0755); err != nil {
 			return "", err
@@ -485,12 +621,10 @@ func mountFs(chroot string, fs models.ModelsV1Filesystem) (string, error) {
 	} else if err != nil {
 		return "", err
 	}
-	opts := optionSliceToString(fs.Mountoptions, ",")
-	log.Info("mount filesystem", "device", *fs.Device, "path", path, "format", fs.Format, "opts", opts)
-	err := os.ExecuteCommand("mount", "-o", opts, "-t", *fs.Format, *fs.Device, path)
+	err := mountWithOptions(source, path, fstype, options)
 	if err != nil {
-		log.Error("mount filesystem failed", "device", *fs.Device, "path", fs.Path, "opts", opts, "error", err)
-		return "", fmt.Errorf("unable to create filesystem %s on %s %w", *fs.Device, fs.Path, err)
+		log.Error("mount filesystem failed", "device", *fs.Device, "path", fs.Path, "error", err)
+		return "", fmt.Errorf("unable to mount filesystem %s on %s %w", *fs.Device, fs.Path, err)
 	}
 	return path, nil
 }
@@ -503,14 +637,6 @@ func depth(path string) uint {
 	return count
 }
 
-func optionSliceToString(opts []string, separator string) string {
-	mountOpts := make([]string, len(opts))
-	for i, o := range opts {
-		mountOpts[i] = string(o)
-	}
-	return strings.Join(mountOpts, separator)
-}
-
 // write all fstab entries to /etc/fstab inside chroot
 func (fss fstabEntries) write(chroot string) error {
 	entries := []string{}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	gos "os"
+	"os/exec"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/os"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+// imageCacheLabel identifies the filesystem of the image cache, ext4 labels are limited to 16 characters
+const imageCacheLabel = "metal-imgcache"
+
+// MountImageCache mounts the image cache of the layout at dir and returns false if the layout has no image cache.
+// Must be called after Run, which creates the partition or logical volume of the cache.
+//
+// The filesystem of the cache is only created if the device does not contain it yet. Partitions of a disk which is
+// wiped on reinstall are recreated at the same location and logical volumes are kept, therefore the cached images
+// survive reinstalls with the same layout. Disks are still wiped completely when the machine is freed.
+func (f *Filesystem) MountImageCache(dir string) (bool, error) {
+	err := validateImageCache(f.config)
+	if err != nil || f.config.Imagecache == nil {
+		return false, err
+	}
+	device := *f.config.Imagecache.Device
+
+	if !hasImageCache(device) {
+		log.Info("create image cache filesystem", "device", device)
+		// the cache contains few large files, no blocks are reserved for root
+		err = os.ExecuteCommand(command.MKFSExt4, "-F", "-L", imageCacheLabel, "-m", "0", "-T", "largefile", device)
+		if err != nil {
+			return false, fmt.Errorf("unable to create image cache filesystem on %s %w", device, err)
+		}
+	}
+
+	err = gos.MkdirAll(dir, 0700)
+	if err != nil {
+		return false, fmt.Errorf("unable to create mount point of image cache %s %w", dir, err)
+	}
+	err = mountWithOptions(device, dir, "ext4", []string{"noatime"})
+	if err != nil {
+		return false, err
+	}
+	f.mounts = append(f.mounts, dir)
+	return true, nil
+}
+
+// hasImageCache returns true if device contains a consistent image cache filesystem,
+// a filesystem which can not be repaired is recreated and loses all cached images.
+func hasImageCache(device string) bool {
+	properties, err := FetchBlockIDProperties(device)
+	if err != nil || properties["TYPE"] != "ext4" || properties["LABEL"] != imageCacheLabel {
+		return false
+	}
+	err = os.ExecuteCommand(command.E2FSck, "-p", device)
+	var exitErr *exec.ExitError
+	// e2fsck exits with 1 if it corrected errors
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		log.Warn("image cache filesystem is corrupted", "device", device, "error", err)
+		return false
+	}
+	log.Info("keep existing image cache", "device", device)
+	return true
+}
+
+// validateImageCache checks that the image cache is not used by other parts of the layout.
+func validateImageCache(config models.ModelsV1FilesystemLayoutResponse) error {
+	cache := config.Imagecache
+	if cache == nil {
+		return nil
+	}
+	if cache.Device == nil || *cache.Device == "" {
+		return fmt.Errorf("image cache requires a device")
+	}
+	device := *cache.Device
+	for _, fs := range config.Filesystems {
+		if fs.Device != nil && *fs.Device == device {
+			return fmt.Errorf("image cache %s must not contain a filesystem of the layout", device)
+		}
+	}
+	for _, disk := range config.Disks {
+		if disk.Device != nil && *disk.Device == device {
+			return fmt.Errorf("image cache %s must not be a partitioned disk", device)
+		}
+	}
+	for _, raid := range config.Raid {
+		for _, d := range raid.Devices {
+			if d == device {
+				return fmt.Errorf("image cache %s must not be a device of a raid", device)
+			}
+		}
+	}
+	for _, vg := range config.Volumegroups {
+		for _, d := range vg.Devices {
+			if d == device {
+				return fmt.Errorf("image cache %s must not be a device of a volume group", device)
+			}
+		}
+	}
+	if raw := config.Rawimage; raw != nil && raw.Device != nil && (device == *raw.Device || onDisk(device, *raw.Device)) {
+		return fmt.Errorf("image cache %s must not be located on the raw image", device)
+	}
+	return nil
+}
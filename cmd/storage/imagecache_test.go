@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func TestValidateImageCache(t *testing.T) {
+	sda, sda3, sdb, sdb1, lv := "/dev/sda", "/dev/sda3", "/dev/sdb", "/dev/sdb1", "/dev/vg00/images"
+	tests := []struct {
+		name    string
+		config  models.ModelsV1FilesystemLayoutResponse
+		wantErr bool
+	}{
+		{name: "no image cache"},
+		{
+			name: "partition",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Imagecache:  &models.ModelsV1ImageCache{Device: &sda3},
+				Disks:       []*models.ModelsV1Disk{{Device: &sda}},
+				Filesystems: []*models.ModelsV1Filesystem{{Path: "/", Device: &sdb1}},
+			},
+		},
+		{
+			name: "logical volume",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Imagecache:   &models.ModelsV1ImageCache{Device: &lv},
+				Volumegroups: []*models.ModelsV1VolumeGroup{{Devices: []string{sda3}}},
+			},
+		},
+		{
+			name:    "device missing",
+			config:  models.ModelsV1FilesystemLayoutResponse{Imagecache: &models.ModelsV1ImageCache{}},
+			wantErr: true,
+		},
+		{
+			name: "filesystem of the layout",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Imagecache:  &models.ModelsV1ImageCache{Device: &sda3},
+				Filesystems: []*models.ModelsV1Filesystem{{Path: "/var", Device: &sda3}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "partitioned disk",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Imagecache: &models.ModelsV1ImageCache{Device: &sda},
+				Disks:      []*models.ModelsV1Disk{{Device: &sda}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "raid device",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Imagecache: &models.ModelsV1ImageCache{Device: &sda3},
+				Raid:       []*models.ModelsV1Raid{{Devices: []string{sda3, sdb1}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "physical volume",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Imagecache:   &models.ModelsV1ImageCache{Device: &sda3},
+				Volumegroups: []*models.ModelsV1VolumeGroup{{Devices: []string{sda3}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "raw image",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Imagecache: &models.ModelsV1ImageCache{Device: &sdb1},
+				Rawimage:   &models.ModelsV1RawImage{Device: &sdb},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateImageCache(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateImageCache() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
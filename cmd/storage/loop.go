@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	gos "os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/os"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+// CreateImageFile creates a sparse file of the given size in bytes which can be attached as loop device.
+func CreateImageFile(file string, size int64) error {
+	f, err := gos.Create(file)
+	if err != nil {
+		return fmt.Errorf("unable to create image file %s %w", file, err)
+	}
+	defer f.Close()
+	err = f.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("unable to resize image file %s to %d bytes %w", file, size, err)
+	}
+	return nil
+}
+
+// AttachLoopDevice attaches the given file to the next free loop device with partition scanning enabled
+// and returns the path of the loop device, e.g. /dev/loop0.
+func AttachLoopDevice(file string) (string, error) {
+	path, err := exec.LookPath(command.Losetup)
+	if err != nil {
+		return "", fmt.Errorf("unable to locate program:%s in path %w", command.Losetup, err)
+	}
+	out, err := exec.Command(path, "--find", "--show", "--partscan", file).Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to attach %s to a loop device %w", file, err)
+	}
+	device := strings.TrimSpace(string(out))
+	log.Info("attached loop device", "file", file, "device", device)
+	return device, nil
+}
+
+// DetachLoopDevice detaches the given loop device from its backing file.
+func DetachLoopDevice(device string) error {
+	log.Info("detach loop device", "device", device)
+	err := os.ExecuteCommand(command.Losetup, "--detach", device)
+	if err != nil {
+		return fmt.Errorf("unable to detach loop device %s %w", device, err)
+	}
+	return nil
+}
+
+// ConvertImageFile converts a raw image file into the given format with qemu-img,
+// the raw file is removed afterwards and the path of the converted file is returned.
+func ConvertImageFile(file, format string) (string, error) {
+	converted := strings.TrimSuffix(file, filepath.Ext(file)) + "." + format
+	log.Info("convert image file", "file", file, "format", format)
+	err := os.ExecuteCommand(command.QemuImg, "convert", "-f", "raw", "-O", format, file, converted)
+	if err != nil {
+		return "", fmt.Errorf("unable to convert %s to %s %w", file, format, err)
+	}
+	err = gos.Remove(file)
+	if err != nil {
+		log.Warn("unable to remove raw image file, ignoring...", "file", file, "error", err)
+	}
+	return converted, nil
+}
+
+// RemapDevices replaces all disk devices referenced in the layout by the given replacements,
+// partitions of a replaced disk are renamed accordingly, e.g. /dev/sda1 becomes /dev/loop0p1.
+func RemapDevices(config *models.ModelsV1FilesystemLayoutResponse, devices map[string]string) {
+	for _, disk := range config.Disks {
+		if disk.Device != nil {
+			device := remapDevice(*disk.Device, devices)
+			disk.Device = &device
+		}
+	}
+	for _, raid := range config.Raid {
+		for i := range raid.Devices {
+			raid.Devices[i] = remapDevice(raid.Devices[i], devices)
+		}
+	}
+	for _, vg := range config.Volumegroups {
+		for i := range vg.Devices {
+			vg.Devices[i] = remapDevice(vg.Devices[i], devices)
+		}
+	}
+	for _, fs := range config.Filesystems {
+		if fs.Device != nil {
+			device := remapDevice(*fs.Device, devices)
+			fs.Device = &device
+		}
+	}
+}
+
+func remapDevice(device string, devices map[string]string) string {
+	for from, to := range devices {
+		if device == from {
+			return to
+		}
+		if !strings.HasPrefix(device, from) {
+			continue
+		}
+		// nvme partitions are separated by a "p" from the disk, e.g. /dev/nvme0n1p1
+		number := strings.TrimPrefix(strings.TrimPrefix(device, from), "p")
+		if _, err := strconv.Atoi(number); err != nil {
+			continue
+		}
+		return to + "p" + number
+	}
+	return device
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func TestRemapDevices(t *testing.T) {
+	sda := "/dev/sda"
+	nvme := "/dev/nvme0n1"
+	sda1 := "/dev/sda1"
+	nvme0n1p2 := "/dev/nvme0n1p2"
+	md := "/dev/md/root"
+	config := &models.ModelsV1FilesystemLayoutResponse{
+		Disks: []*models.ModelsV1Disk{
+			{Device: &sda},
+			{Device: &nvme},
+		},
+		Raid: []*models.ModelsV1Raid{
+			{Devices: []string{"/dev/sda2", "/dev/nvme0n1p3"}},
+		},
+		Volumegroups: []*models.ModelsV1VolumeGroup{
+			{Devices: []string{"/dev/sdab1", "/dev/nvme0n1p4"}},
+		},
+		Filesystems: []*models.ModelsV1Filesystem{
+			{Device: &sda1},
+			{Device: &nvme0n1p2},
+			{Device: &md},
+		},
+	}
+	devices := map[string]string{
+		"/dev/sda":     "/dev/loop0",
+		"/dev/nvme0n1": "/dev/loop1",
+	}
+
+	RemapDevices(config, devices)
+
+	got := []string{*config.Disks[0].Device, *config.Disks[1].Device}
+	got = append(got, config.Raid[0].Devices...)
+	got = append(got, config.Volumegroups[0].Devices...)
+	for _, fs := range config.Filesystems {
+		got = append(got, *fs.Device)
+	}
+	want := []string{
+		"/dev/loop0", "/dev/loop1",
+		"/dev/loop0p2", "/dev/loop1p3",
+		"/dev/sdab1", "/dev/loop1p4",
+		"/dev/loop0p1", "/dev/loop1p2", "/dev/md/root",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RemapDevices() = %v, want %v", got, want)
+	}
+}
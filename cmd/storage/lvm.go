@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+const (
+	lvmTypeLinear    = "linear"
+	lvmTypeStriped   = "striped"
+	lvmTypeRaid1     = "raid1"
+	lvmTypeRaid5     = "raid5"
+	lvmTypeRaid6     = "raid6"
+	lvmTypeRaid10    = "raid10"
+	lvmTypeThinPool  = "thin-pool"
+	lvmTypeThin      = "thin"
+	cacheTypeCache   = "cache"
+	cacheTypeWrite   = "writecache"
+	cacheModeThrough = "writethrough"
+	cacheModeBack    = "writeback"
+)
+
+// lvmTypeMinPVs is the minimum number of physical volumes required by a lvm type
+var lvmTypeMinPVs = map[string]int{
+	lvmTypeLinear:   1,
+	lvmTypeThinPool: 1,
+	lvmTypeThin:     1,
+	lvmTypeStriped:  2,
+	lvmTypeRaid1:    2,
+	lvmTypeRaid5:    3,
+	lvmTypeRaid6:    5,
+	lvmTypeRaid10:   4,
+}
+
+func lvmType(lv *models.ModelsV1LogicalVolume) string {
+	if lv.Lvmtype == nil || *lv.Lvmtype == "" {
+		return lvmTypeLinear
+	}
+	return *lv.Lvmtype
+}
+
+// pvCount returns the number of physical volumes a logical volume can be allocated on.
+func pvCount(lv *models.ModelsV1LogicalVolume, vgs map[string]*models.ModelsV1VolumeGroup) int {
+	if len(lv.Devices) > 0 {
+		return len(lv.Devices)
+	}
+	vg, ok := vgs[*lv.Volumegroup]
+	if !ok {
+		return 0
+	}
+	return len(vg.Devices)
+}
+
+// effectiveLvmType returns the lvm type which is actually created, striped and raid1 volumes on a single pv
+// fall back to linear to be able to use the same layout on machines with only one disk.
+func effectiveLvmType(lv *models.ModelsV1LogicalVolume, pvs int) string {
+	t := lvmType(lv)
+	if pvs < 2 && (t == lvmTypeStriped || t == lvmTypeRaid1) {
+		return lvmTypeLinear
+	}
+	return t
+}
+
+// validateLogicalVolumes checks all logical volumes of the layout before anything is created.
+func validateLogicalVolumes(config models.ModelsV1FilesystemLayoutResponse) error {
+	vgs := make(map[string]*models.ModelsV1VolumeGroup)
+	for _, vg := range config.Volumegroups {
+		if vg.Name != nil {
+			vgs[*vg.Name] = vg
+		}
+	}
+	lvs := make(map[string]*models.ModelsV1LogicalVolume)
+	for _, lv := range config.Logicalvolumes {
+		if lv.Name != nil && lv.Volumegroup != nil {
+			lvs[*lv.Volumegroup+"/"+*lv.Name] = lv
+		}
+	}
+
+	for _, lv := range config.Logicalvolumes {
+		if lv.Name == nil || *lv.Name == "" || lv.Volumegroup == nil || *lv.Volumegroup == "" {
+			continue
+		}
+		name := *lv.Volumegroup + "/" + *lv.Name
+		t := lvmType(lv)
+		minPVs, ok := lvmTypeMinPVs[t]
+		if !ok {
+			return fmt.Errorf("unsupported lvmtype:%s of %s", t, name)
+		}
+		pvs := pvCount(lv, vgs)
+		if effectiveLvmType(lv, pvs) == t && pvs < minPVs {
+			return fmt.Errorf("lvmtype:%s of %s requires at least %d physical volumes, got %d", t, name, minPVs, pvs)
+		}
+
+		if lv.Stripesize > 0 {
+			switch t {
+			case lvmTypeStriped, lvmTypeRaid5, lvmTypeRaid6, lvmTypeRaid10:
+			default:
+				return fmt.Errorf("stripesize is not supported for lvmtype:%s of %s", t, name)
+			}
+			if lv.Stripesize < 4 || lv.Stripesize&(lv.Stripesize-1) != 0 {
+				return fmt.Errorf("stripesize %d KiB of %s must be a power of two and at least 4 KiB", lv.Stripesize, name)
+			}
+		}
+
+		if t == lvmTypeThin {
+			if lv.Size == nil || *lv.Size <= 0 {
+				return fmt.Errorf("thin volume %s requires a size", name)
+			}
+			pool, ok := lvs[*lv.Volumegroup+"/"+lv.Thinpool]
+			if !ok || lvmType(pool) != lvmTypeThinPool {
+				return fmt.Errorf("thin pool %q of %s not found", lv.Thinpool, name)
+			}
+		}
+
+		if lv.Cachevolume != "" {
+			cache, ok := lvs[*lv.Volumegroup+"/"+lv.Cachevolume]
+			if !ok {
+				return fmt.Errorf("cache volume %q of %s not found", lv.Cachevolume, name)
+			}
+			if cache.Cachevolume != "" || lvmType(cache) == lvmTypeThin || lvmType(cache) == lvmTypeThinPool {
+				return fmt.Errorf("cache volume %q of %s must be a plain volume", lv.Cachevolume, name)
+			}
+			switch lv.Cachetype {
+			case "", cacheTypeCache:
+				switch lv.Cachemode {
+				case "", cacheModeThrough, cacheModeBack:
+				default:
+					return fmt.Errorf("unsupported cachemode:%s of %s", lv.Cachemode, name)
+				}
+			case cacheTypeWrite:
+				if lv.Cachemode != "" {
+					return fmt.Errorf("cachemode is not supported for cachetype:%s of %s", lv.Cachetype, name)
+				}
+			default:
+				return fmt.Errorf("unsupported cachetype:%s of %s", lv.Cachetype, name)
+			}
+		}
+	}
+	return nil
+}
+
+// lvCreateArgs returns the arguments of lvcreate for the given logical volume which is allocated on pvs physical volumes.
+func lvCreateArgs(lv *models.ModelsV1LogicalVolume, pvs int) []string {
+	args := []string{
+		"lvcreate",
+		"--verbose",
+		"--name", *lv.Name,
+		"--wipesignatures", "y",
+	}
+
+	t := effectiveLvmType(lv, pvs)
+	if t == lvmTypeThin {
+		return append(args, "--virtualsize", fmt.Sprintf("%dm", *lv.Size), "--thin", *lv.Volumegroup+"/"+lv.Thinpool)
+	}
+
+	if *lv.Size > int64(0) {
+		args = append(args, "--size", fmt.Sprintf("%dm", *lv.Size))
+	} else {
+		args = append(args, "--extents", "100%FREE")
+	}
+
+	switch t {
+	case lvmTypeLinear:
+	case lvmTypeThinPool:
+		args = append(args, "--type", lvmTypeThinPool)
+	case lvmTypeStriped:
+		args = append(args, "--type", "striped", "--stripes", fmt.Sprintf("%d", pvs))
+	case lvmTypeRaid1:
+		args = append(args, "--type", "raid1", "--mirrors", "1", "--nosync")
+	case lvmTypeRaid5:
+		args = append(args, "--type", "raid5", "--stripes", fmt.Sprintf("%d", pvs-1))
+	case lvmTypeRaid6:
+		args = append(args, "--type", "raid6", "--stripes", fmt.Sprintf("%d", pvs-2))
+	case lvmTypeRaid10:
+		args = append(args, "--type", "raid10", "--mirrors", "1", "--stripes", fmt.Sprintf("%d", pvs/2), "--nosync")
+	}
+	if lv.Stripesize > 0 && t != lvmTypeLinear {
+		args = append(args, "--stripesize", fmt.Sprintf("%dk", lv.Stripesize))
+	}
+
+	args = append(args, *lv.Volumegroup)
+	return append(args, lv.Devices...)
+}
+
+// lvConvertCacheArgs returns the arguments of lvconvert to attach the cache volume to the given logical volume.
+func lvConvertCacheArgs(lv *models.ModelsV1LogicalVolume) []string {
+	cacheType := lv.Cachetype
+	if cacheType == "" {
+		cacheType = cacheTypeCache
+	}
+	args := []string{"lvconvert", "--yes", "--type", cacheType, "--cachevol", lv.Cachevolume}
+	if cacheType == cacheTypeCache {
+		mode := lv.Cachemode
+		if mode == "" {
+			mode = cacheModeThrough
+		}
+		args = append(args, "--cachemode", mode)
+	}
+	return append(args, *lv.Volumegroup+"/"+*lv.Name)
+}
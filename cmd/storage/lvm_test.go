@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func newLogicalVolume(name, lvmtype string, size int64) *models.ModelsV1LogicalVolume {
+	vg := "vg00"
+	return &models.ModelsV1LogicalVolume{Name: &name, Lvmtype: &lvmtype, Size: &size, Volumegroup: &vg}
+}
+
+func TestLvCreateArgs(t *testing.T) {
+	striped := newLogicalVolume("data", "striped", 0)
+	striped.Stripesize = 256
+	cache := newLogicalVolume("fast", "linear", 1000)
+	cache.Devices = []string{"/dev/nvme0n1p1"}
+	thin := newLogicalVolume("thin", "thin", 2000)
+	thin.Thinpool = "pool"
+
+	tests := []struct {
+		name string
+		lv   *models.ModelsV1LogicalVolume
+		pvs  int
+		want []string
+	}{
+		{
+			name: "striped with stripesize",
+			lv:   striped,
+			pvs:  4,
+			want: []string{"lvcreate", "--verbose", "--name", "data", "--wipesignatures", "y", "--extents", "100%FREE", "--type", "striped", "--stripes", "4", "--stripesize", "256k", "vg00"},
+		},
+		{
+			name: "raid1 on single pv falls back to linear",
+			lv:   newLogicalVolume("root", "raid1", 100),
+			pvs:  1,
+			want: []string{"lvcreate", "--verbose", "--name", "root", "--wipesignatures", "y", "--size", "100m", "vg00"},
+		},
+		{
+			name: "raid6",
+			lv:   newLogicalVolume("data", "raid6", 100),
+			pvs:  6,
+			want: []string{"lvcreate", "--verbose", "--name", "data", "--wipesignatures", "y", "--size", "100m", "--type", "raid6", "--stripes", "4", "vg00"},
+		},
+		{
+			name: "raid10",
+			lv:   newLogicalVolume("data", "raid10", 100),
+			pvs:  4,
+			want: []string{"lvcreate", "--verbose", "--name", "data", "--wipesignatures", "y", "--size", "100m", "--type", "raid10", "--mirrors", "1", "--stripes", "2", "--nosync", "vg00"},
+		},
+		{
+			name: "thin pool",
+			lv:   newLogicalVolume("pool", "thin-pool", 0),
+			pvs:  1,
+			want: []string{"lvcreate", "--verbose", "--name", "pool", "--wipesignatures", "y", "--extents", "100%FREE", "--type", "thin-pool", "vg00"},
+		},
+		{
+			name: "thin volume",
+			lv:   thin,
+			pvs:  1,
+			want: []string{"lvcreate", "--verbose", "--name", "thin", "--wipesignatures", "y", "--virtualsize", "2000m", "--thin", "vg00/pool"},
+		},
+		{
+			name: "cache volume on nvme",
+			lv:   cache,
+			pvs:  1,
+			want: []string{"lvcreate", "--verbose", "--name", "fast", "--wipesignatures", "y", "--size", "1000m", "vg00", "/dev/nvme0n1p1"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lvCreateArgs(tt.lv, tt.pvs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lvCreateArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLvConvertCacheArgs(t *testing.T) {
+	slow := newLogicalVolume("slow", "raid5", 0)
+	slow.Cachevolume = "fast"
+	want := []string{"lvconvert", "--yes", "--type", "cache", "--cachevol", "fast", "--cachemode", "writethrough", "vg00/slow"}
+	if got := lvConvertCacheArgs(slow); !reflect.DeepEqual(got, want) {
+		t.Errorf("lvConvertCacheArgs() = %v, want %v", got, want)
+	}
+	slow.Cachetype = "writecache"
+	want = []string{"lvconvert", "--yes", "--type", "writecache", "--cachevol", "fast", "vg00/slow"}
+	if got := lvConvertCacheArgs(slow); !reflect.DeepEqual(got, want) {
+		t.Errorf("lvConvertCacheArgs() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateLogicalVolumes(t *testing.T) {
+	vgName := "vg00"
+	layout := func(lvs ...*models.ModelsV1LogicalVolume) models.ModelsV1FilesystemLayoutResponse {
+		return models.ModelsV1FilesystemLayoutResponse{
+			Volumegroups: []*models.ModelsV1VolumeGroup{
+				{Name: &vgName, Devices: []string{"/dev/sda", "/dev/sdb", "/dev/sdc", "/dev/nvme0n1"}},
+			},
+			Logicalvolumes: lvs,
+		}
+	}
+	cached := newLogicalVolume("slow", "raid5", 0)
+	cached.Devices = []string{"/dev/sda", "/dev/sdb", "/dev/sdc"}
+	cached.Cachevolume = "fast"
+	badStripes := newLogicalVolume("data", "striped", 0)
+	badStripes.Stripesize = 100
+	thin := newLogicalVolume("thin", "thin", 100)
+	thin.Thinpool = "missing"
+	writecache := newLogicalVolume("slow", "linear", 0)
+	writecache.Cachevolume = "fast"
+	writecache.Cachetype = "writecache"
+	writecache.Cachemode = "writeback"
+
+	tests := []struct {
+		name    string
+		layout  models.ModelsV1FilesystemLayoutResponse
+		wantErr bool
+	}{
+		{name: "cached raid5", layout: layout(newLogicalVolume("fast", "linear", 100), cached)},
+		{name: "raid6 with too few pvs", layout: layout(newLogicalVolume("data", "raid6", 0)), wantErr: true},
+		{name: "unsupported type", layout: layout(newLogicalVolume("data", "raid4", 0)), wantErr: true},
+		{name: "stripesize not a power of two", layout: layout(badStripes), wantErr: true},
+		{name: "thin pool missing", layout: layout(newLogicalVolume("pool", "thin-pool", 0), thin), wantErr: true},
+		{name: "cache volume missing", layout: layout(cached), wantErr: true},
+		{name: "writecache with cachemode", layout: layout(newLogicalVolume("fast", "linear", 100), writecache), wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLogicalVolumes(tt.layout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateLogicalVolumes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	gos "os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/sys/unix"
+)
+
+var mountInfo = "/proc/self/mountinfo"
+
+type mount struct {
+	source  string
+	target  string
+	fstype  string
+	options []string
+}
+
+// mountFlag is a fstab style mount option which is translated to a mount flag,
+// clear is set for options which remove the flag again, e.g. rw clears MS_RDONLY.
+type mountFlag struct {
+	flag  uintptr
+	clear bool
+}
+
+// mountFlags see man 8 mount for reference
+var mountFlags = map[string]mountFlag{
+	"ro":          {flag: syscall.MS_RDONLY},
+	"rw":          {flag: syscall.MS_RDONLY, clear: true},
+	"nosuid":      {flag: syscall.MS_NOSUID},
+	"suid":        {flag: syscall.MS_NOSUID, clear: true},
+	"nodev":       {flag: syscall.MS_NODEV},
+	"dev":         {flag: syscall.MS_NODEV, clear: true},
+	"noexec":      {flag: syscall.MS_NOEXEC},
+	"exec":        {flag: syscall.MS_NOEXEC, clear: true},
+	"sync":        {flag: syscall.MS_SYNCHRONOUS},
+	"async":       {flag: syscall.MS_SYNCHRONOUS, clear: true},
+	"dirsync":     {flag: syscall.MS_DIRSYNC},
+	"noatime":     {flag: syscall.MS_NOATIME},
+	"atime":       {flag: syscall.MS_NOATIME, clear: true},
+	"nodiratime":  {flag: syscall.MS_NODIRATIME},
+	"diratime":    {flag: syscall.MS_NODIRATIME, clear: true},
+	"relatime":    {flag: syscall.MS_RELATIME},
+	"norelatime":  {flag: syscall.MS_RELATIME, clear: true},
+	"strictatime": {flag: syscall.MS_STRICTATIME},
+	"lazytime":    {flag: unix.MS_LAZYTIME},
+	"silent":      {flag: syscall.MS_SILENT},
+	"loud":        {flag: syscall.MS_SILENT, clear: true},
+	"bind":        {flag: syscall.MS_BIND},
+	"rbind":       {flag: syscall.MS_BIND | syscall.MS_REC},
+}
+
+// userspaceMountOptions are only evaluated by mount(8) or systemd and must not be passed to the kernel
+var userspaceMountOptions = map[string]bool{
+	"defaults": true,
+	"auto":     true,
+	"noauto":   true,
+	"user":     true,
+	"nouser":   true,
+	"users":    true,
+	"nofail":   true,
+	"_netdev":  true,
+	"sw":       true,
+}
+
+// parseMountOptions translates fstab style mount options into mount flags and filesystem specific data,
+// every option can itself contain multiple comma separated options.
+func parseMountOptions(options []string) (uintptr, string) {
+	flags := uintptr(0)
+	data := []string{}
+	for _, option := range options {
+		for _, o := range strings.Split(option, ",") {
+			o = strings.TrimSpace(o)
+			if o == "" || userspaceMountOptions[o] || strings.HasPrefix(o, "x-") || strings.HasPrefix(o, "pri=") {
+				continue
+			}
+			if f, ok := mountFlags[o]; ok {
+				if f.clear {
+					flags &^= f.flag
+				} else {
+					flags |= f.flag
+				}
+				continue
+			}
+			data = append(data, o)
+		}
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// mountWithOptions mounts source to target with the given fstab style options and verifies that the mount is present afterwards.
+func mountWithOptions(source, target, fstype string, options []string) error {
+	flags, data := parseMountOptions(options)
+	log.Info("mount", "source", source, "target", target, "fstype", fstype, "flags", flags, "data", data)
+	err := syscall.Mount(source, target, fstype, flags, data)
+	if err != nil {
+		return fmt.Errorf("mounting %s to %s failed %w", source, target, err)
+	}
+
+	// a bind mount ignores all other flags, they must be applied with a remount
+	remountFlags := flags &^ (syscall.MS_BIND | syscall.MS_REC)
+	if flags&syscall.MS_BIND != 0 && remountFlags != 0 {
+		err = syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|remountFlags, "")
+		if err != nil {
+			return fmt.Errorf("remounting bind mount %s with flags %d failed %w", target, remountFlags, err)
+		}
+	}
+
+	mounted, err := isMounted(target)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("mount of %s to %s not present after mounting", source, target)
+	}
+	return nil
+}
+
+// isMounted returns true if a filesystem is mounted at the given target.
+func isMounted(target string) (bool, error) {
+	f, err := gos.Open(mountInfo)
+	if err != nil {
+		return false, fmt.Errorf("unable to read %s %w", mountInfo, err)
+	}
+	defer f.Close()
+	mountPoints, err := parseMountInfo(f)
+	if err != nil {
+		return false, err
+	}
+	target = filepath.Clean(target)
+	for _, mp := range mountPoints {
+		if mp == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseMountInfo returns all mount points of a mountinfo file, see man 5 proc:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(r io.Reader) ([]string, error) {
+	result := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		result = append(result, unescapeMountInfo(fields[4]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to parse mountinfo %w", err)
+	}
+	return result, nil
+}
+
+// unescapeMountInfo replaces the octal escapes of space, tab, newline and backslash in mountinfo paths.
+func unescapeMountInfo(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   []string
+		wantFlags uintptr
+		wantData  string
+	}{
+		{
+			name:      "defaults",
+			options:   []string{"defaults"},
+			wantFlags: 0,
+			wantData:  "",
+		},
+		{
+			name:      "flags and data",
+			options:   []string{"ro", "noatime,nodev", "nosuid", "subvol=@root", "size=512m", "x-systemd.automount", "nofail"},
+			wantFlags: syscall.MS_RDONLY | syscall.MS_NOATIME | syscall.MS_NODEV | syscall.MS_NOSUID,
+			wantData:  "subvol=@root,size=512m",
+		},
+		{
+			name:      "later options clear earlier ones",
+			options:   []string{"ro,noexec", "rw", "exec"},
+			wantFlags: 0,
+			wantData:  "",
+		},
+		{
+			name:      "bind mount",
+			options:   []string{"rbind", "ro"},
+			wantFlags: syscall.MS_BIND | syscall.MS_REC | syscall.MS_RDONLY,
+			wantData:  "",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			flags, data := parseMountOptions(tt.options)
+			if flags != tt.wantFlags {
+				t.Errorf("parseMountOptions() flags = %x, want %x", flags, tt.wantFlags)
+			}
+			if data != tt.wantData {
+				t.Errorf("parseMountOptions() data = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountinfo := `22 1 8:2 / / rw,relatime shared:1 - ext4 /dev/sda2 rw
+23 22 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+60 22 8:3 / /rootfs/var/lib/with\040space rw,relatime shared:30 - ext4 /dev/sda3 rw
+`
+	got, err := parseMountInfo(strings.NewReader(mountinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/proc", "/rootfs/var/lib/with space"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMountInfo() = %v, want %v", got, want)
+	}
+}
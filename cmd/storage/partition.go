@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"fmt"
+	gos "os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+const (
+	mib = uint64(1024 * 1024)
+	// gptEntriesSize is the size of the gpt partition entry array which is stored at the beginning and the end of the disk
+	gptEntriesSize = uint64(16384)
+)
+
+var sysClassBlock = "/sys/class/block"
+
+// geometry of a disk as reported by the kernel
+type geometry struct {
+	// size of the disk in bytes
+	size              uint64
+	logicalBlockSize  uint64
+	physicalBlockSize uint64
+	optimalIOSize     uint64
+}
+
+// partitionRange is the position of a partition on disk in logical sectors, end is inclusive
+type partitionRange struct {
+	number int64
+	start  uint64
+	end    uint64
+}
+
+// readGeometry reads the geometry of the given disk device from sysfs.
+func readGeometry(device string) (*geometry, error) {
+	name := filepath.Base(device)
+	read := func(attribute string) (uint64, error) {
+		content, err := gos.ReadFile(filepath.Join(sysClassBlock, name, attribute))
+		if err != nil {
+			return 0, fmt.Errorf("unable to read %s of %s %w", attribute, device, err)
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	}
+
+	// size is always reported in 512 byte sectors, independent of the logical block size
+	sectors, err := read("size")
+	if err != nil {
+		return nil, err
+	}
+	g := &geometry{size: sectors * 512}
+	g.logicalBlockSize, err = read("queue/logical_block_size")
+	if err != nil {
+		return nil, err
+	}
+	g.physicalBlockSize, err = read("queue/physical_block_size")
+	if err != nil {
+		return nil, err
+	}
+	g.optimalIOSize, err = read("queue/optimal_io_size")
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// calculatePartitionRanges reads the geometry of the given disk device and calculates the position of all partitions
+// keyed by partition number, the alignment is returned in logical sectors.
+func calculatePartitionRanges(device string, disk *models.ModelsV1Disk) (map[int64]partitionRange, uint64, error) {
+	g, err := readGeometry(device)
+	if err != nil {
+		return nil, 0, err
+	}
+	alignment := g.alignment(uint64(disk.Alignment) * 1024)
+	ranges, err := partitionRanges(*g, alignment, disk.Partitions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to calculate partitions of %s %w", device, err)
+	}
+	result := make(map[int64]partitionRange)
+	for _, r := range ranges {
+		log.Info("partition", "device", device, "number", r.number, "start", r.start, "end", r.end, "alignment", alignment)
+		result[r.number] = r
+	}
+	return result, alignment / g.logicalBlockSize, nil
+}
+
+// alignment returns the alignment in bytes, which is a multiple of 1MiB, the physical block size,
+// the optimal io size and the requested alignment.
+func (g geometry) alignment(requested uint64) uint64 {
+	result := mib
+	for _, a := range []uint64{g.logicalBlockSize, g.physicalBlockSize, g.optimalIOSize, requested} {
+		if a > 0 {
+			result = lcm(result, a)
+		}
+	}
+	return result
+}
+
+// firstUsable returns the first byte after the primary gpt header and partition entries.
+func (g geometry) firstUsable() uint64 {
+	return 2*g.logicalBlockSize + gptEntriesSize
+}
+
+// lastUsable returns the last byte before the backup gpt partition entries and header.
+func (g geometry) lastUsable() uint64 {
+	return g.size - g.logicalBlockSize - gptEntriesSize - 1
+}
+
+// needsGeometry returns true if partitions of this disk can only be created with the knowledge of the disk geometry.
+func needsGeometry(disk *models.ModelsV1Disk) bool {
+	if disk.Alignment > 0 {
+		return true
+	}
+	for _, p := range disk.Partitions {
+		if p.Sizepercent > 0 || p.Minsize > 0 || p.Maxsize > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionRanges calculates the position of all partitions on a disk with the given geometry.
+// Partitions are either sized fixed in MiB, in percent of the usable disk space, or take the remaining space
+// if neither is given. Percent and remaining space are bound by the optional min and max size.
+// All partitions start and end at multiples of the alignment, sizes are rounded down accordingly.
+func partitionRanges(g geometry, alignment uint64, partitions []*models.ModelsV1DiskPartition) ([]partitionRange, error) {
+	start := roundUp(g.firstUsable(), alignment)
+	end := roundDown(g.lastUsable()+1, alignment)
+	if end <= start {
+		return nil, fmt.Errorf("disk of %d bytes is too small for alignment of %d bytes", g.size, alignment)
+	}
+	usable := end - start
+
+	sizes := make([]uint64, len(partitions))
+	remaining := -1
+	allocated := uint64(0)
+	for i, p := range partitions {
+		if p.Number == nil {
+			return nil, fmt.Errorf("partition without number")
+		}
+		switch {
+		case p.Sizepercent > 0:
+			if p.Sizepercent > 100 {
+				return nil, fmt.Errorf("partition %d size of %d percent exceeds 100 percent", *p.Number, p.Sizepercent)
+			}
+			sizes[i] = bound(usable/100*uint64(p.Sizepercent), p)
+		case p.Size != nil && *p.Size > 0:
+			sizes[i] = uint64(*p.Size) * mib
+		default:
+			if remaining >= 0 {
+				return nil, fmt.Errorf("partition %d and %d both take the remaining space", *partitions[remaining].Number, *p.Number)
+			}
+			remaining = i
+			continue
+		}
+		sizes[i] = roundDown(sizes[i], alignment)
+		if sizes[i] == 0 {
+			return nil, fmt.Errorf("partition %d is smaller than the alignment of %d bytes", *p.Number, alignment)
+		}
+		allocated += sizes[i]
+	}
+	if allocated > usable {
+		return nil, fmt.Errorf("partitions require %d bytes but only %d bytes are usable", allocated, usable)
+	}
+	if remaining >= 0 {
+		size := roundDown(bound(usable-allocated, partitions[remaining]), alignment)
+		if size == 0 || size > usable-allocated {
+			return nil, fmt.Errorf("not enough space left for partition %d", *partitions[remaining].Number)
+		}
+		sizes[remaining] = size
+	}
+
+	result := []partitionRange{}
+	for i, p := range partitions {
+		result = append(result, partitionRange{
+			number: *p.Number,
+			start:  start / g.logicalBlockSize,
+			end:    (start+sizes[i])/g.logicalBlockSize - 1,
+		})
+		start += sizes[i]
+	}
+	return result, nil
+}
+
+// bound limits the size to the min and max size of the partition.
+func bound(size uint64, p *models.ModelsV1DiskPartition) uint64 {
+	if p.Minsize > 0 && size < uint64(p.Minsize)*mib {
+		size = uint64(p.Minsize) * mib
+	}
+	if p.Maxsize > 0 && size > uint64(p.Maxsize)*mib {
+		size = uint64(p.Maxsize) * mib
+	}
+	return size
+}
+
+func roundUp(value, multiple uint64) uint64 {
+	return (value + multiple - 1) / multiple * multiple
+}
+
+func roundDown(value, multiple uint64) uint64 {
+	return value / multiple * multiple
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func lcm(a, b uint64) uint64 {
+	return a / gcd(a, b) * b
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func TestPartitionRanges(t *testing.T) {
+	one, two, three := int64(1), int64(2), int64(3)
+	size500 := int64(500)
+	size0 := int64(0)
+	tenGiB := uint64(10 * 1024 * 1024 * 1024)
+
+	tests := []struct {
+		name       string
+		geometry   geometry
+		requested  uint64
+		partitions []*models.ModelsV1DiskPartition
+		want       []partitionRange
+		wantErr    bool
+	}{
+		{
+			name:     "512e disk with fixed, percent and bound remaining partition",
+			geometry: geometry{size: tenGiB, logicalBlockSize: 512, physicalBlockSize: 4096},
+			partitions: []*models.ModelsV1DiskPartition{
+				{Number: &one, Size: &size500},
+				{Number: &two, Sizepercent: 50},
+				{Number: &three, Size: &size0, Maxsize: 4000},
+			},
+			want: []partitionRange{
+				{number: 1, start: 2048, end: 1026047},
+				{number: 2, start: 1026048, end: 11507711},
+				{number: 3, start: 11507712, end: 19699711},
+			},
+		},
+		{
+			name:     "4Kn nvme with optimal io size",
+			geometry: geometry{size: tenGiB, logicalBlockSize: 4096, physicalBlockSize: 4096, optimalIOSize: 786432},
+			partitions: []*models.ModelsV1DiskPartition{
+				{Number: &one, Sizepercent: 1, Minsize: 100},
+				{Number: &two},
+			},
+			want: []partitionRange{
+				{number: 1, start: 768, end: 26879},
+				{number: 2, start: 26880, end: 2621183},
+			},
+		},
+		{
+			name:     "two partitions with remaining space",
+			geometry: geometry{size: tenGiB, logicalBlockSize: 512, physicalBlockSize: 512},
+			partitions: []*models.ModelsV1DiskPartition{
+				{Number: &one},
+				{Number: &two, Size: &size0},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "partitions exceed disk",
+			geometry: geometry{size: tenGiB, logicalBlockSize: 512, physicalBlockSize: 512},
+			partitions: []*models.ModelsV1DiskPartition{
+				{Number: &one, Sizepercent: 90},
+				{Number: &two, Sizepercent: 10, Minsize: 2048},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := partitionRanges(tt.geometry, tt.geometry.alignment(tt.requested), tt.partitions)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("partitionRanges() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("partitionRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeometryAlignment(t *testing.T) {
+	g := geometry{logicalBlockSize: 4096, physicalBlockSize: 4096, optimalIOSize: 786432}
+	if got := g.alignment(0); got != 3*mib {
+		t.Errorf("alignment() = %d, want %d", got, 3*mib)
+	}
+	g = geometry{logicalBlockSize: 512, physicalBlockSize: 4096}
+	if got := g.alignment(2048 * 1024); got != 2*mib {
+		t.Errorf("alignment() = %d, want %d", got, 2*mib)
+	}
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"fmt"
+	gos "os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/pkg/os"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	umountRetries    = 5
+	umountRetryDelay = time.Second
+	// killTimeout is the time processes get to terminate before they are killed
+	killTimeout = 3 * time.Second
+)
+
+var procDir = "/proc"
+
+// Quiesce brings the storage into a state where a kexec is safe.
+// All buffers are synced, processes started from the chroot are terminated, all filesystems are
+// unmounted in reverse order, zfs pools are exported, volume groups are deactivated and raid arrays are stopped.
+// An error is returned if the root filesystem of the target could not be unmounted cleanly
+// or a zfs pool could not be exported.
+func (f *Filesystem) Quiesce() error {
+	log.Info("quiesce storage")
+	unix.Sync()
+
+	f.killChrootProcesses()
+
+	err := f.umountFilesystems()
+	if err != nil {
+		return err
+	}
+	err = f.exportZPools()
+	if err != nil {
+		return err
+	}
+	unix.Sync()
+
+	f.deactivate()
+	return nil
+}
+
+// killChrootProcesses terminates all processes which run inside the chroot, e.g. daemons started by install.sh.
+func (f *Filesystem) killChrootProcesses() {
+	pids := chrootProcesses(procDir, f.chroot)
+	if len(pids) == 0 {
+		return
+	}
+	log.Warn("terminate leftover processes of chroot", "pids", pids)
+	for _, pid := range pids {
+		_ = syscall.Kill(pid, syscall.SIGTERM)
+	}
+	deadline := time.Now().Add(killTimeout)
+	for time.Now().Before(deadline) {
+		if len(chrootProcesses(procDir, f.chroot)) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, pid := range chrootProcesses(procDir, f.chroot) {
+		log.Warn("kill leftover process of chroot", "pid", pid)
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// chrootProcesses returns the pids of all processes whose root directory is the given chroot or below.
+func chrootProcesses(proc, chroot string) []int {
+	entries, err := gos.ReadDir(proc)
+	if err != nil {
+		log.Error("unable to list processes", "error", err)
+		return nil
+	}
+	chroot = filepath.Clean(chroot)
+	self := gos.Getpid()
+	result := []int{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		root, err := gos.Readlink(filepath.Join(proc, e.Name(), "root"))
+		if err != nil {
+			continue
+		}
+		if root == chroot || strings.HasPrefix(root, chroot+"/") {
+			result = append(result, pid)
+		}
+	}
+	return result
+}
+
+// mountPoints returns all mount points in the order they must be unmounted.
+func (f *Filesystem) mountPoints() []string {
+	result := []string{}
+	for index := len(specialMounts) - 1; index >= 0; index-- {
+		result = append(result, filepath.Join(f.chroot, specialMounts[index].target))
+	}
+	for index := len(f.mounts) - 1; index >= 0; index-- {
+		if f.mounts[index] == "" {
+			continue
+		}
+		result = append(result, f.mounts[index])
+	}
+	return result
+}
+
+// umountFilesystems unmounts all filesystems in reverse order, every unmount is retried
+// and falls back to a lazy unmount. Only a failed unmount of the root filesystem is returned as error,
+// because the target os would boot from a filesystem which was not cleanly unmounted.
+func (f *Filesystem) umountFilesystems() error {
+	root := filepath.Clean(f.chroot)
+	for _, m := range f.mountPoints() {
+		mounted, err := isMounted(m)
+		if err != nil {
+			log.Error("unable to check mount", "path", m, "error", err)
+		}
+		if err == nil && !mounted {
+			continue
+		}
+		err = umount(m)
+		if err == nil {
+			continue
+		}
+		if filepath.Clean(m) == root {
+			return fmt.Errorf("unable to unmount root filesystem %s %w", m, err)
+		}
+		log.Warn("unable to unmount, fallback to lazy unmount", "path", m, "error", err)
+		err = syscall.Unmount(m, syscall.MNT_DETACH)
+		if err != nil {
+			log.Error("unable to lazy unmount", "path", m, "error", err)
+		}
+	}
+	return nil
+}
+
+func umount(mountPoint string) error {
+	var err error
+	for i := 0; i < umountRetries; i++ {
+		log.Info("unmounting", "mountpoint", mountPoint, "attempt", i+1)
+		err = syscall.Unmount(mountPoint, 0)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(umountRetryDelay)
+	}
+	return err
+}
+
+// deactivate deactivates all volume groups and stops all raid arrays of the layout to release the underlying devices,
+// failures are only logged because all filesystems are already unmounted at this point.
+func (f *Filesystem) deactivate() {
+	for _, vg := range f.config.Volumegroups {
+		if vg.Name == nil || *vg.Name == "" {
+			continue
+		}
+		log.Info("deactivate volume group", "vg", *vg.Name)
+		err := os.ExecuteCommand(command.LVM, "vgchange", "--activate", "n", *vg.Name)
+		if err != nil {
+			log.Error("unable to deactivate volume group", "vg", *vg.Name, "error", err)
+		}
+	}
+	for _, raid := range f.config.Raid {
+		if raid.Arrayname == nil {
+			continue
+		}
+		log.Info("stop mdadm raid", "array", *raid.Arrayname)
+		err := os.ExecuteCommand(command.MDADM, "--stop", *raid.Arrayname)
+		if err != nil {
+			log.Error("unable to stop mdadm raid", "array", *raid.Arrayname, "error", err)
+		}
+	}
+}
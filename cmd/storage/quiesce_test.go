@@ -0,0 +1,56 @@
+package storage
+
+import (
+	gos "os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChrootProcesses(t *testing.T) {
+	proc := t.TempDir()
+	processes := map[string]string{
+		"1":    "/",
+		"42":   "/rootfs",
+		"43":   "/rootfs/usr",
+		"44":   "/rootfs2",
+		"self": "/rootfs",
+	}
+	for pid, root := range processes {
+		err := gos.MkdirAll(filepath.Join(proc, pid), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = gos.Symlink(root, filepath.Join(proc, pid, "root"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := chrootProcesses(proc, "/rootfs/")
+	want := []int{42, 43}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chrootProcesses() = %v, want %v", got, want)
+	}
+}
+
+func TestMountPoints(t *testing.T) {
+	f := &Filesystem{
+		chroot: "/rootfs",
+		mounts: []string{"/rootfs", "/rootfs/boot/efi", "", "/rootfs/var"},
+	}
+	got := f.mountPoints()
+	want := []string{
+		"/rootfs/dev",
+		"/rootfs/tmp",
+		"/rootfs/sys/firmware/efi/efivars",
+		"/rootfs/sys",
+		"/rootfs/proc",
+		"/rootfs/var",
+		"/rootfs/boot/efi",
+		"/rootfs",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mountPoints() = %v, want %v", got, want)
+	}
+}
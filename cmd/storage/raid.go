@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"fmt"
+	gos "os"
+	"os/exec"
+	"path"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+	"github.com/metal-stack/v"
+)
+
+// RaidArray describes a created mdadm array, it is passed to the install.sh of the target os
+// to be able to regenerate the initramfs with stable array names.
+type RaidArray struct {
+	// Name of the array device, e.g. /dev/md/root
+	Name string `yaml:"name"`
+	// UUID of the array as stored in the superblock in mdadm notation
+	UUID string `yaml:"uuid"`
+	// Level of the array, e.g. raid1
+	Level string `yaml:"level"`
+	// Metadata version of the superblock
+	Metadata string `yaml:"metadata"`
+	// MDName is the name stored in the superblock including the homehost, e.g. any:root
+	MDName string `yaml:"mdname"`
+}
+
+// RaidArrays returns all arrays which where created.
+func (f *Filesystem) RaidArrays() []RaidArray {
+	return f.raidArrays
+}
+
+// readRaidDetails queries mdadm for the details of the given array.
+func readRaidDetails(array string) (*RaidArray, error) {
+	path, err := exec.LookPath(command.MDADM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate program:%s in path %w", command.MDADM, err)
+	}
+	out, err := exec.Command(path, "--detail", "--export", array).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get details of raid %s %w", array, err)
+	}
+	return parseRaidDetails(array, string(out))
+}
+
+// readRaidArrays collects the details of the existing arrays of the layout, which were assembled by activateLayout,
+// they are required for the mdadm.conf of the target os if the raids are kept.
+func (f *Filesystem) readRaidArrays() error {
+	for _, raid := range f.config.Raid {
+		if raid.Arrayname == nil {
+			continue
+		}
+		details, err := readRaidDetails(*raid.Arrayname)
+		if err != nil {
+			return err
+		}
+		f.raidArrays = append(f.raidArrays, *details)
+	}
+	return nil
+}
+
+// parseRaidDetails parses the output of mdadm --detail --export /dev/md/root:
+//
+//	MD_LEVEL=raid1
+//	MD_DEVICES=2
+//	MD_METADATA=1.2
+//	MD_UUID=0e9ab8d5:4d9fa2d8:01b2a5c3:6c6f0a7e
+//	MD_DEVNAME=root
+//	MD_NAME=any:root
+func parseRaidDetails(array, out string) (*RaidArray, error) {
+	props := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		props[keyValue[0]] = keyValue[1]
+	}
+	uuid, ok := props["MD_UUID"]
+	if !ok {
+		return nil, fmt.Errorf("no uuid found for raid %s", array)
+	}
+	return &RaidArray{
+		Name:     array,
+		UUID:     uuid,
+		Level:    props["MD_LEVEL"],
+		Metadata: props["MD_METADATA"],
+		MDName:   props["MD_NAME"],
+	}, nil
+}
+
+// mdadmConf renders the mdadm.conf with one ARRAY line per array.
+func mdadmConf(arrays []RaidArray) string {
+	lines := []string{fmt.Sprintf("# created by metal-hammer: %q", v.V), "HOMEHOST <ignore>"}
+	for _, a := range arrays {
+		line := fmt.Sprintf("ARRAY %s metadata=%s UUID=%s", a.Name, a.Metadata, a.UUID)
+		if a.MDName != "" {
+			line += " name=" + a.MDName
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// dracutConf renders a dracut configuration which ensures that all arrays and volume groups
+// are assembled by the initramfs.
+func dracutConf(arrays []RaidArray, volumegroups []string) string {
+	lines := []string{fmt.Sprintf("# created by metal-hammer: %q", v.V)}
+	cmdline := []string{}
+	if len(arrays) > 0 {
+		lines = append(lines, `mdadmconf="yes"`, `add_dracutmodules+=" mdraid "`)
+		for _, a := range arrays {
+			cmdline = append(cmdline, "rd.md.uuid="+a.UUID)
+		}
+	}
+	if len(volumegroups) > 0 {
+		lines = append(lines, `lvmconf="yes"`, `add_dracutmodules+=" lvm "`)
+		for _, vg := range volumegroups {
+			cmdline = append(cmdline, "rd.lvm.vg="+vg)
+		}
+	}
+	if len(cmdline) > 0 {
+		lines = append(lines, fmt.Sprintf("kernel_cmdline+=\" %s \"", strings.Join(cmdline, " ")))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// CreateRaidConfig writes mdadm.conf and, for dracut based images, a dracut configuration into the target os.
+// Must be called after the image was extracted to not get overwritten by the configuration shipped with the image.
+func (f *Filesystem) CreateRaidConfig() error {
+	if len(f.raidArrays) > 0 {
+		// debian based images expect mdadm.conf in /etc/mdadm, all others directly in /etc
+		mdadmConfPath := path.Join(f.chroot, "etc", "mdadm.conf")
+		if _, err := gos.Stat(path.Join(f.chroot, "etc", "mdadm")); err == nil {
+			mdadmConfPath = path.Join(f.chroot, "etc", "mdadm", "mdadm.conf")
+		}
+		content := mdadmConf(f.raidArrays)
+		log.Info("write mdadm.conf", "path", mdadmConfPath, "content", content)
+		//nolint:gosec
+		err := gos.WriteFile(mdadmConfPath, []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write mdadm.conf %w", err)
+		}
+	}
+
+	volumegroups := []string{}
+	for _, vg := range f.config.Volumegroups {
+		if vg.Name != nil && *vg.Name != "" {
+			volumegroups = append(volumegroups, *vg.Name)
+		}
+	}
+	if len(f.raidArrays) == 0 && len(volumegroups) == 0 {
+		return nil
+	}
+	dracutConfDir := path.Join(f.chroot, "etc", "dracut.conf.d")
+	if _, err := gos.Stat(dracutConfDir); err != nil {
+		log.Info("dracut not present, not creating dracut configuration")
+		return nil
+	}
+	content := dracutConf(f.raidArrays, volumegroups)
+	destination := path.Join(dracutConfDir, "10-metal-storage.conf")
+	log.Info("write dracut configuration", "path", destination, "content", content)
+	//nolint:gosec
+	err := gos.WriteFile(destination, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write dracut configuration %w", err)
+	}
+	return nil
+}
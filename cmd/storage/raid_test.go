@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func TestParseRaidDetails(t *testing.T) {
+	out := `MD_LEVEL=raid1
+MD_DEVICES=2
+MD_METADATA=1.2
+MD_UUID=0e9ab8d5:4d9fa2d8:01b2a5c3:6c6f0a7e
+MD_DEVNAME=root
+MD_NAME=any:root
+`
+	got, err := parseRaidDetails("/dev/md/root", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RaidArray{
+		Name:     "/dev/md/root",
+		UUID:     "0e9ab8d5:4d9fa2d8:01b2a5c3:6c6f0a7e",
+		Level:    "raid1",
+		Metadata: "1.2",
+		MDName:   "any:root",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRaidDetails() = %v, want %v", got, want)
+	}
+
+	_, err = parseRaidDetails("/dev/md/root", "MD_LEVEL=raid1\n")
+	if err == nil {
+		t.Error("expected error for details without uuid")
+	}
+}
+
+func TestMdadmConfAndDracutConf(t *testing.T) {
+	arrays := []RaidArray{
+		{Name: "/dev/md/root", UUID: "0e9ab8d5:4d9fa2d8:01b2a5c3:6c6f0a7e", Metadata: "1.2", MDName: "any:root"},
+		{Name: "/dev/md/varlib", UUID: "11111111:22222222:33333333:44444444", Metadata: "1.2"},
+	}
+
+	conf := mdadmConf(arrays)
+	for _, line := range []string{
+		"ARRAY /dev/md/root metadata=1.2 UUID=0e9ab8d5:4d9fa2d8:01b2a5c3:6c6f0a7e name=any:root\n",
+		"ARRAY /dev/md/varlib metadata=1.2 UUID=11111111:22222222:33333333:44444444\n",
+	} {
+		if !strings.Contains(conf, line) {
+			t.Errorf("mdadmConf() = %q does not contain %q", conf, line)
+		}
+	}
+
+	dracut := dracutConf(arrays, []string{"csi-lvm"})
+	want := `kernel_cmdline+=" rd.md.uuid=0e9ab8d5:4d9fa2d8:01b2a5c3:6c6f0a7e rd.md.uuid=11111111:22222222:33333333:44444444 rd.lvm.vg=csi-lvm "`
+	if !strings.Contains(dracut, want) {
+		t.Errorf("dracutConf() = %q does not contain %q", dracut, want)
+	}
+}
+
+func TestReadRaidArrays(t *testing.T) {
+	// mdadm reports the details of the array which is given as last argument
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor a; do array=$a; done\necho MD_LEVEL=raid1\necho MD_UUID=uuid-${array##*/}\necho MD_NAME=any:${array##*/}\n"
+	err := os.WriteFile(filepath.Join(bin, "mdadm"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin)
+
+	root, varlib := "/dev/md/root", "/dev/md/varlib"
+	f := &Filesystem{config: models.ModelsV1FilesystemLayoutResponse{
+		Raid: []*models.ModelsV1Raid{{Arrayname: &root}, {}, {Arrayname: &varlib}},
+	}}
+	err = f.readRaidArrays()
+	if err != nil {
+		t.Fatalf("readRaidArrays() error = %v", err)
+	}
+	want := []RaidArray{
+		{Name: root, UUID: "uuid-root", Level: "raid1", MDName: "any:root"},
+		{Name: varlib, UUID: "uuid-varlib", Level: "raid1", MDName: "any:varlib"},
+	}
+	if !reflect.DeepEqual(f.RaidArrays(), want) {
+		t.Errorf("readRaidArrays() = %v, want %v", f.RaidArrays(), want)
+	}
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/os"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+// gptPartition are the properties of a gpt partition which are required to recreate it, as reported by sgdisk --info
+type gptPartition struct {
+	typeCode   string
+	guid       string
+	firstLBA   uint64
+	attributes uint64
+	name       string
+}
+
+// RawImageDevice returns the disk a raw image is written to instead of extracting a tarball into the chroot,
+// empty if the layout does not contain a raw image. The partitions of the raw image are not created by Run,
+// filesystems of the layout which are located on them are only mounted.
+func (f *Filesystem) RawImageDevice() (string, error) {
+	err := validateRawImage(f.config)
+	if err != nil || f.config.Rawimage == nil {
+		return "", err
+	}
+	return *f.config.Rawimage.Device, nil
+}
+
+// validateRawImage checks that the disk of the raw image is not partitioned by the layout and contains no root slots.
+func validateRawImage(config models.ModelsV1FilesystemLayoutResponse) error {
+	raw := config.Rawimage
+	if raw == nil {
+		return nil
+	}
+	if raw.Device == nil || *raw.Device == "" {
+		return fmt.Errorf("raw image requires a device")
+	}
+	for _, disk := range config.Disks {
+		if disk.Device != nil && *disk.Device == *raw.Device {
+			return fmt.Errorf("disk %s of the raw image must not be partitioned by the layout", *raw.Device)
+		}
+	}
+	for _, fs := range config.Filesystems {
+		if fs.Slot != "" && fs.Device != nil && onDisk(*fs.Device, *raw.Device) {
+			return fmt.Errorf("root slot %s must not be located on the raw image", fs.Slot)
+		}
+	}
+	return nil
+}
+
+// onDisk returns true if device is a partition of disk.
+func onDisk(device, disk string) bool {
+	if !strings.HasPrefix(device, disk) {
+		return false
+	}
+	// nvme partitions are separated by a "p" from the disk, e.g. /dev/nvme0n1p1
+	number := strings.TrimPrefix(strings.TrimPrefix(device, disk), "p")
+	_, err := strconv.ParseUint(number, 10, 64)
+	return err == nil
+}
+
+// onRawImage returns true if the filesystem is located on a partition of the raw image.
+func (f *Filesystem) onRawImage(fs *models.ModelsV1Filesystem) bool {
+	if f.config.Rawimage == nil || f.config.Rawimage.Device == nil || fs.Device == nil {
+		return false
+	}
+	return onDisk(*fs.Device, *f.config.Rawimage.Device)
+}
+
+// partitionDevice returns the device of partition number of disk.
+func partitionDevice(disk string, number int64) string {
+	if disk != "" && disk[len(disk)-1] >= '0' && disk[len(disk)-1] <= '9' {
+		return fmt.Sprintf("%sp%d", disk, number)
+	}
+	return fmt.Sprintf("%s%d", disk, number)
+}
+
+// ExpandRawImage moves the backup gpt header of the raw image, which was written for the size of the image,
+// to the end of the disk and grows the configured partition and its filesystem to the end of the disk.
+// Must be called after the raw image was written and before Run.
+func (f *Filesystem) ExpandRawImage() error {
+	device, err := f.RawImageDevice()
+	if err != nil || device == "" {
+		return err
+	}
+	log.Info("repair backup gpt header of raw image", "device", device)
+	err = os.ExecuteCommand(command.SGDisk, "--move-second-header", device)
+	if err != nil {
+		return fmt.Errorf("unable to repair backup gpt header of %s %w", device, err)
+	}
+
+	number := f.config.Rawimage.Growpartition
+	if number <= 0 {
+		return nil
+	}
+	//nolint:gosec
+	out, err := exec.Command(command.SGDisk, fmt.Sprintf("--info=%d", number), device).Output()
+	if err != nil {
+		return fmt.Errorf("unable to read partition %d of %s %w", number, device, err)
+	}
+	p, err := parseGPTPartition(string(out))
+	if err != nil {
+		return fmt.Errorf("unable to read partition %d of %s %w", number, device, err)
+	}
+	args := growPartitionArgs(number, p)
+	args = append(args, device)
+	log.Info("grow partition of raw image", "device", device, "partition", number, "args", args)
+	err = os.ExecuteCommand(command.SGDisk, args...)
+	if err != nil {
+		return fmt.Errorf("unable to grow partition %d of %s %w", number, device, err)
+	}
+
+	return f.growFilesystem(partitionDevice(device, number))
+}
+
+// growPartitionArgs returns the sgdisk arguments which recreate the partition at the same start with the largest
+// possible end, all other properties of the partition are kept.
+func growPartitionArgs(number int64, p *gptPartition) []string {
+	args := []string{
+		fmt.Sprintf("--delete=%d", number),
+		fmt.Sprintf("--new=%d:%d:0", number, p.firstLBA),
+		fmt.Sprintf("--typecode=%d:%s", number, p.typeCode),
+		fmt.Sprintf("--partition-guid=%d:%s", number, p.guid),
+		fmt.Sprintf("--change-name=%d:%s", number, p.name),
+	}
+	for bit := 0; bit < 64; bit++ {
+		if p.attributes&(1<<bit) != 0 {
+			args = append(args, fmt.Sprintf("--attributes=%d:set:%d", number, bit))
+		}
+	}
+	return args
+}
+
+// growFilesystem resizes the filesystem of the layout on the given partition to the size of the partition,
+// only ext3 and ext4 can be resized without being mounted.
+func (f *Filesystem) growFilesystem(partition string) error {
+	for _, fs := range f.config.Filesystems {
+		if fs.Device == nil || *fs.Device != partition || fs.Format == nil {
+			continue
+		}
+		switch *fs.Format {
+		case "ext3", "ext4":
+		default:
+			log.Warn("filesystem of grown partition is not resized", "device", partition, "format", *fs.Format)
+			return nil
+		}
+		log.Info("grow filesystem of raw image", "device", partition)
+		// resize2fs refuses to resize a filesystem which was not checked since it was last mounted
+		err := os.ExecuteCommand(command.E2FSck, "-f", "-p", partition)
+		var exitErr *exec.ExitError
+		// e2fsck exits with 1 if it corrected errors
+		if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+			return fmt.Errorf("unable to check filesystem on %s %w", partition, err)
+		}
+		err = os.ExecuteCommand(command.Resize2FS, partition)
+		if err != nil {
+			return fmt.Errorf("unable to grow filesystem on %s %w", partition, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// parseGPTPartition parses the output of sgdisk --info:
+//
+//	Partition GUID code: 0FC63DAF-8483-4772-8E79-3D69D8477DE4 (Linux filesystem)
+//	Partition unique GUID: 5B1E6B0C-5F4B-4E1F-9E0A-6C1B2F8E1A3D
+//	First sector: 4096 (at 2.0 MiB)
+//	Last sector: 4194270 (at 2.0 GiB)
+//	Partition size: 4190175 sectors (2.0 GiB)
+//	Attribute flags: 0000000000000000
+//	Partition name: 'root'
+func parseGPTPartition(out string) (*gptPartition, error) {
+	props := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		keyValue := strings.SplitN(line, ":", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		props[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	p := &gptPartition{
+		guid: props["Partition unique GUID"],
+		name: strings.TrimSuffix(strings.TrimPrefix(props["Partition name"], "'"), "'"),
+	}
+	typeCode := strings.Fields(props["Partition GUID code"])
+	if len(typeCode) == 0 || p.guid == "" {
+		return nil, fmt.Errorf("partition does not exist")
+	}
+	p.typeCode = typeCode[0]
+	firstSector := strings.Fields(props["First sector"])
+	if len(firstSector) == 0 {
+		return nil, fmt.Errorf("first sector of partition missing")
+	}
+	var err error
+	p.firstLBA, err = strconv.ParseUint(firstSector[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse first sector %w", err)
+	}
+	p.attributes, err = strconv.ParseUint(props["Attribute flags"], 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse attribute flags %w", err)
+	}
+	return p, nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+const sgdiskInfo = `Partition GUID code: 0FC63DAF-8483-4772-8E79-3D69D8477DE4 (Linux filesystem)
+Partition unique GUID: 5B1E6B0C-5F4B-4E1F-9E0A-6C1B2F8E1A3D
+First sector: 4096 (at 2.0 MiB)
+Last sector: 4194270 (at 2.0 GiB)
+Partition size: 4190175 sectors (2.0 GiB)
+Attribute flags: 0000000000000004
+Partition name: 'root'
+`
+
+func TestParseGPTPartition(t *testing.T) {
+	got, err := parseGPTPartition(sgdiskInfo)
+	if err != nil {
+		t.Fatalf("parseGPTPartition() error = %v", err)
+	}
+	want := &gptPartition{
+		typeCode:   "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+		guid:       "5B1E6B0C-5F4B-4E1F-9E0A-6C1B2F8E1A3D",
+		firstLBA:   4096,
+		attributes: 4,
+		name:       "root",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseGPTPartition() = %v, want %v", got, want)
+	}
+
+	_, err = parseGPTPartition("Partition #3 does not exist.")
+	if err == nil {
+		t.Errorf("parseGPTPartition() expected error for a missing partition")
+	}
+
+	args := growPartitionArgs(3, got)
+	wantArgs := []string{
+		"--delete=3",
+		"--new=3:4096:0",
+		"--typecode=3:0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+		"--partition-guid=3:5B1E6B0C-5F4B-4E1F-9E0A-6C1B2F8E1A3D",
+		"--change-name=3:root",
+		"--attributes=3:set:2",
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("growPartitionArgs() = %v, want %v", args, wantArgs)
+	}
+}
+
+func TestValidateRawImage(t *testing.T) {
+	sda, sda2, sdb := "/dev/sda", "/dev/sda2", "/dev/sdb"
+	tests := []struct {
+		name    string
+		config  models.ModelsV1FilesystemLayoutResponse
+		wantErr bool
+	}{
+		{name: "no raw image"},
+		{
+			name: "raw image with filesystems",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Rawimage:    &models.ModelsV1RawImage{Device: &sda},
+				Disks:       []*models.ModelsV1Disk{{Device: &sdb}},
+				Filesystems: []*models.ModelsV1Filesystem{{Path: "/", Device: &sda2}},
+			},
+		},
+		{
+			name:    "device missing",
+			config:  models.ModelsV1FilesystemLayoutResponse{Rawimage: &models.ModelsV1RawImage{}},
+			wantErr: true,
+		},
+		{
+			name: "disk partitioned by layout",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Rawimage: &models.ModelsV1RawImage{Device: &sda},
+				Disks:    []*models.ModelsV1Disk{{Device: &sda}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "root slot on raw image",
+			config: models.ModelsV1FilesystemLayoutResponse{
+				Rawimage:    &models.ModelsV1RawImage{Device: &sda},
+				Filesystems: []*models.ModelsV1Filesystem{{Path: "/", Device: &sda2, Slot: "a"}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRawImage(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRawImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOnDisk(t *testing.T) {
+	tests := []struct {
+		device string
+		disk   string
+		want   bool
+	}{
+		{device: "/dev/sda2", disk: "/dev/sda", want: true},
+		{device: "/dev/nvme0n1p1", disk: "/dev/nvme0n1", want: true},
+		{device: "/dev/sda", disk: "/dev/sda"},
+		{device: "/dev/sdab1", disk: "/dev/sda"},
+		{device: "/dev/md0", disk: "/dev/sda"},
+	}
+	for _, tt := range tests {
+		if got := onDisk(tt.device, tt.disk); got != tt.want {
+			t.Errorf("onDisk(%s, %s) = %v, want %v", tt.device, tt.disk, got, tt.want)
+		}
+	}
+	if got := partitionDevice("/dev/nvme0n1", 2); got != "/dev/nvme0n1p2" {
+		t.Errorf("partitionDevice() = %s, want /dev/nvme0n1p2", got)
+	}
+	if got := partitionDevice("/dev/vda", 2); got != "/dev/vda2" {
+		t.Errorf("partitionDevice() = %s, want /dev/vda2", got)
+	}
+}
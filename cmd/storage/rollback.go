@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/pkg/os"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+// resource is a storage resource created during Run which is removed again if Run fails
+type resource struct {
+	kind   string
+	name   string
+	remove func() error
+}
+
+func (r resource) String() string {
+	return r.kind + " " + r.name
+}
+
+// track remembers a created resource to be able to roll it back.
+func (f *Filesystem) track(kind, name string, remove func() error) {
+	f.created = append(f.created, resource{kind: kind, name: name, remove: remove})
+}
+
+// rollback removes all created resources in reverse order of their creation, failures are logged
+// and do not stop the rollback of the remaining resources. It returns the resources which were rolled back
+// and the ones which failed.
+func (f *Filesystem) rollback() ([]string, []string) {
+	rolledBack := []string{}
+	failed := []string{}
+	for index := len(f.created) - 1; index >= 0; index-- {
+		r := f.created[index]
+		log.Info("rollback", "resource", r.String())
+		err := r.remove()
+		if err != nil {
+			log.Error("rollback failed", "resource", r.String(), "error", err)
+			failed = append(failed, r.String())
+			continue
+		}
+		rolledBack = append(rolledBack, r.String())
+	}
+	f.created = nil
+	f.mounts = nil
+	f.zpools = nil
+	f.raidArrays = nil
+	f.fstabEntries = fstabEntries{}
+	return rolledBack, failed
+}
+
+// rollbackError tears down all created resources and adds what was rolled back to the error.
+func (f *Filesystem) rollbackError(err error) error {
+	rolledBack, failed := f.rollback()
+	if len(failed) > 0 {
+		return fmt.Errorf("%w, rolled back:[%s], rollback failed:[%s]", err, strings.Join(rolledBack, ", "), strings.Join(failed, ", "))
+	}
+	return fmt.Errorf("%w, rolled back:[%s]", err, strings.Join(rolledBack, ", "))
+}
+
+func (f *Filesystem) trackMount(path string) {
+	f.track("mount", path, func() error {
+		err := umount(path)
+		if err != nil {
+			return syscall.Unmount(path, syscall.MNT_DETACH)
+		}
+		return nil
+	})
+}
+
+func (f *Filesystem) trackPartitions(device string) {
+	f.track("partitions", device, func() error {
+		err := os.ExecuteCommand(command.SGDisk, "--zap-all", device)
+		if err != nil {
+			return err
+		}
+		return os.ExecuteCommand(command.WIPEFS, "--all", device)
+	})
+}
+
+func (f *Filesystem) trackRaid(array string, devices []string) {
+	f.track("raid", array, func() error {
+		err := os.ExecuteCommand(command.MDADM, "--stop", array)
+		if err != nil {
+			return err
+		}
+		return os.ExecuteCommand(command.MDADM, append([]string{"--zero-superblock"}, devices...)...)
+	})
+}
+
+func (f *Filesystem) trackVolumeGroup(vg string, devices []string) {
+	f.track("volumegroup", vg, func() error {
+		err := os.ExecuteCommand(command.LVM, "vgremove", "--force", vg)
+		if err != nil {
+			return err
+		}
+		return os.ExecuteCommand(command.LVM, append([]string{"pvremove", "--force", "--force", "--yes"}, devices...)...)
+	})
+}
+
+func (f *Filesystem) trackLogicalVolume(vg, lv string) {
+	f.track("logicalvolume", vg+"/"+lv, func() error {
+		return os.ExecuteCommand(command.LVM, "lvremove", "--force", vg+"/"+lv)
+	})
+}
+
+func (f *Filesystem) trackFilesystem(device string) {
+	f.track("filesystem", device, func() error {
+		return os.ExecuteCommand(command.WIPEFS, "--all", device)
+	})
+}
+
+func (f *Filesystem) trackZPool(pool string, imported bool) {
+	f.track("zpool", pool, func() error {
+		if imported {
+			return os.ExecuteCommand(command.ZPool, "export", pool)
+		}
+		return os.ExecuteCommand(command.ZPool, "destroy", "-f", pool)
+	})
+}
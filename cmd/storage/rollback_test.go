@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	f := &Filesystem{mounts: []string{"/rootfs"}, zpools: []string{"tank"}}
+	removed := []string{}
+	remove := func(name string, err error) func() error {
+		return func() error {
+			removed = append(removed, name)
+			return err
+		}
+	}
+	f.track("partitions", "/dev/sda", remove("/dev/sda", nil))
+	f.track("raid", "/dev/md/root", remove("/dev/md/root", errors.New("busy")))
+	f.track("filesystem", "/dev/md/root", remove("fs", nil))
+	f.track("mount", "/rootfs", remove("/rootfs", nil))
+
+	err := f.rollbackError(errors.New("create filesystems failed"))
+
+	wantRemoved := []string{"/rootfs", "fs", "/dev/md/root", "/dev/sda"}
+	if !reflect.DeepEqual(removed, wantRemoved) {
+		t.Errorf("rollback() removed %v, want %v", removed, wantRemoved)
+	}
+	want := "create filesystems failed, rolled back:[mount /rootfs, filesystem /dev/md/root, partitions /dev/sda], rollback failed:[raid /dev/md/root]"
+	if err.Error() != want {
+		t.Errorf("rollbackError() = %q, want %q", err.Error(), want)
+	}
+	if len(f.created) != 0 || len(f.mounts) != 0 || len(f.zpools) != 0 {
+		t.Errorf("rollback() did not reset the state")
+	}
+
+	err = f.rollbackError(errors.New("again"))
+	if !strings.HasSuffix(err.Error(), "rolled back:[]") {
+		t.Errorf("rollbackError() = %q, want nothing rolled back", err.Error())
+	}
+}
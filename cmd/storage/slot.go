@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"fmt"
+	gos "os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/cmd/utils"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/kernel"
+	"github.com/metal-stack/metal-hammer/pkg/os"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+// bootinfoFile is written by install.sh of the target os, relative to its root
+const bootinfoFile = "etc/metal/boot-info.yaml"
+
+// rootSlot is one of the two root filesystems of a layout with A/B root slots
+type rootSlot struct {
+	name string
+	fs   *models.ModelsV1Filesystem
+}
+
+// rootSlots returns the root slots of the layout, either none or exactly two.
+func rootSlots(config models.ModelsV1FilesystemLayoutResponse) ([]rootSlot, error) {
+	slots := []rootSlot{}
+	for _, fs := range config.Filesystems {
+		if fs.Slot == "" {
+			continue
+		}
+		if fs.Path != "/" {
+			return nil, fmt.Errorf("root slot %s must be mounted at / not at %s", fs.Slot, fs.Path)
+		}
+		if fs.Device == nil || fs.Format == nil {
+			return nil, fmt.Errorf("root slot %s requires a device and a format", fs.Slot)
+		}
+		slots = append(slots, rootSlot{name: fs.Slot, fs: fs})
+	}
+	if len(slots) == 0 {
+		return nil, nil
+	}
+	if len(slots) != 2 {
+		return nil, fmt.Errorf("layout must contain exactly two root slots, got %d", len(slots))
+	}
+	if slots[0].name == slots[1].name {
+		return nil, fmt.Errorf("root slots must have different names, got %s twice", slots[0].name)
+	}
+	return slots, nil
+}
+
+// selectSlot returns the slot with the newest completed installation as active slot and the other one as target slot.
+// If no slot contains an installation, there is no active slot and the first slot is the target.
+func selectSlot(slots []rootSlot, infos map[string]*kernel.Bootinfo) (string, string) {
+	active := ""
+	var newest time.Time
+	for _, s := range slots {
+		info, ok := infos[s.name]
+		if !ok {
+			continue
+		}
+		installed, err := time.Parse(time.RFC3339, info.Installed)
+		if err != nil {
+			continue
+		}
+		if active == "" || installed.After(newest) {
+			active = s.name
+			newest = installed
+		}
+	}
+	if active == "" {
+		return "", slots[0].name
+	}
+	for _, s := range slots {
+		if s.name != active {
+			return active, s.name
+		}
+	}
+	return active, ""
+}
+
+// PrepareRootSlot detects the active root slot of a layout with A/B root slots and selects the other one as target,
+// partitions, raids, volumes and all other filesystems are kept if an active slot was found.
+// Must be called before Run.
+func (f *Filesystem) PrepareRootSlot() error {
+	slots, err := rootSlots(f.config)
+	if err != nil || len(slots) == 0 {
+		return err
+	}
+
+	f.activateLayout()
+	infos := make(map[string]*kernel.Bootinfo)
+	for _, s := range slots {
+		info, err := readSlotBootinfo(s)
+		if err != nil {
+			log.Info("no installation found in root slot", "slot", s.name, "reason", err)
+			continue
+		}
+		infos[s.name] = info
+	}
+
+	active, target := selectSlot(slots, infos)
+	f.targetSlot = target
+	if active == "" {
+		log.Info("no installed root slot found, install into first slot", "slot", target)
+		return nil
+	}
+	log.Info("install into inactive root slot", "active", active, "target", target)
+	f.preserve = true
+	f.fallback = infos[active]
+	return nil
+}
+
+// activateLayout assembles all raid arrays and activates all volume groups of a previous installation.
+func (f *Filesystem) activateLayout() {
+	if len(f.config.Raid) > 0 {
+		err := os.ExecuteCommand(command.MDADM, "--assemble", "--scan")
+		if err != nil {
+			log.Warn("unable to assemble raid arrays", "error", err)
+		}
+	}
+	if len(f.config.Volumegroups) > 0 {
+		err := os.ExecuteCommand(command.LVM, "vgchange", "--activate", "y")
+		if err != nil {
+			log.Warn("unable to activate volume groups", "error", err)
+		}
+	}
+}
+
+// readSlotBootinfo reads boot-info.yaml of the installation in the given slot, kernel and initrd
+// are copied to be able to kexec into the slot without mounting it.
+func readSlotBootinfo(s rootSlot) (*kernel.Bootinfo, error) {
+	dir, err := gos.MkdirTemp("", "slot-"+s.name+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer gos.Remove(dir)
+
+	err = mountWithOptions(*s.fs.Device, dir, *s.fs.Format, []string{"ro"})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := syscall.Unmount(dir, 0)
+		if err != nil {
+			log.Error("unable to unmount root slot", "slot", s.name, "error", err)
+		}
+	}()
+
+	info, err := kernel.ReadBootinfo(path.Join(dir, bootinfoFile))
+	if err != nil {
+		return nil, err
+	}
+	if info.Slot != s.name || info.Installed == "" {
+		return nil, fmt.Errorf("installation in slot %s is not complete", s.name)
+	}
+
+	tmp := path.Join("/tmp", "slot-"+s.name)
+	err = gos.MkdirAll(tmp, 0755)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range []*string{&info.Kernel, &info.Initrd} {
+		if *file == "" {
+			continue
+		}
+		destination := path.Join(tmp, filepath.Base(*file))
+		_, err = utils.Copy(path.Join(dir, *file), destination)
+		if err != nil {
+			return nil, fmt.Errorf("unable to copy %s of slot %s %w", *file, s.name, err)
+		}
+		*file = destination
+	}
+	return info, nil
+}
+
+// RootSlot returns the slot the os is installed into, empty if the layout has no root slots.
+func (f *Filesystem) RootSlot() string {
+	return f.targetSlot
+}
+
+// FallbackBootinfo returns the boot information of the active slot which is booted if the installation fails,
+// nil if there is no active slot.
+func (f *Filesystem) FallbackBootinfo() *kernel.Bootinfo {
+	return f.fallback
+}
+
+// CommitRootSlot records the slot and the time of the installation in boot-info.yaml of the target os,
+// the slot with the newest installation is the active slot of the next reinstallation.
+// Must be called after the installation is complete.
+func (f *Filesystem) CommitRootSlot() error {
+	if f.targetSlot == "" {
+		return nil
+	}
+	file := path.Join(f.chroot, bootinfoFile)
+	info, err := kernel.ReadBootinfo(file)
+	if err != nil {
+		return err
+	}
+	info.Slot = f.targetSlot
+	info.Installed = time.Now().UTC().Format(time.RFC3339)
+	log.Info("commit root slot", "slot", info.Slot, "installed", info.Installed)
+	return kernel.WriteBootinfo(file, info)
+}
+
+// skipFilesystem returns true if the filesystem must not be created, or must not be mounted if create is false.
+// The root slot which is not installed into is never touched, all other filesystems are kept if an active slot exists.
+// Filesystems of a raw image are part of the image and never created.
+func (f *Filesystem) skipFilesystem(fs *models.ModelsV1Filesystem, create bool) bool {
+	if create && f.onRawImage(fs) {
+		return true
+	}
+	if fs.Slot != "" {
+		return fs.Slot != f.targetSlot
+	}
+	return create && f.preserve
+}
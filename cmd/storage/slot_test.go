@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/kernel"
+)
+
+func TestRootSlots(t *testing.T) {
+	ext4, sda2, sda3 := "ext4", "/dev/sda2", "/dev/sda3"
+	slot := func(name, path string) *models.ModelsV1Filesystem {
+		return &models.ModelsV1Filesystem{Slot: name, Path: path, Device: &sda2, Format: &ext4}
+	}
+	tests := []struct {
+		name        string
+		filesystems []*models.ModelsV1Filesystem
+		want        int
+		wantErr     bool
+	}{
+		{name: "no slots", filesystems: []*models.ModelsV1Filesystem{{Path: "/", Device: &sda3, Format: &ext4}}},
+		{name: "two slots", filesystems: []*models.ModelsV1Filesystem{slot("a", "/"), slot("b", "/")}, want: 2},
+		{name: "one slot", filesystems: []*models.ModelsV1Filesystem{slot("a", "/")}, wantErr: true},
+		{name: "same name", filesystems: []*models.ModelsV1Filesystem{slot("a", "/"), slot("a", "/")}, wantErr: true},
+		{name: "not root", filesystems: []*models.ModelsV1Filesystem{slot("a", "/"), slot("b", "/var")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rootSlots(models.ModelsV1FilesystemLayoutResponse{Filesystems: tt.filesystems})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rootSlots() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("rootSlots() = %d slots, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectSlot(t *testing.T) {
+	slots := []rootSlot{{name: "a"}, {name: "b"}}
+	tests := []struct {
+		name       string
+		infos      map[string]*kernel.Bootinfo
+		wantActive string
+		wantTarget string
+	}{
+		{name: "fresh installation", infos: map[string]*kernel.Bootinfo{}, wantTarget: "a"},
+		{
+			name:       "a installed",
+			infos:      map[string]*kernel.Bootinfo{"a": {Slot: "a", Installed: "2021-03-01T10:00:00Z"}},
+			wantActive: "a",
+			wantTarget: "b",
+		},
+		{
+			name: "b is newer",
+			infos: map[string]*kernel.Bootinfo{
+				"a": {Slot: "a", Installed: "2021-03-01T10:00:00Z"},
+				"b": {Slot: "b", Installed: "2021-04-01T10:00:00Z"},
+			},
+			wantActive: "b",
+			wantTarget: "a",
+		},
+		{
+			name:       "invalid timestamp",
+			infos:      map[string]*kernel.Bootinfo{"b": {Slot: "b", Installed: "yesterday"}},
+			wantTarget: "a",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			active, target := selectSlot(slots, tt.infos)
+			if active != tt.wantActive || target != tt.wantTarget {
+				t.Errorf("selectSlot() = %q, %q, want %q, %q", active, target, tt.wantActive, tt.wantTarget)
+			}
+		})
+	}
+}
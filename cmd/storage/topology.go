@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	gos "os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+var mdstat = "/proc/mdstat"
+
+// Topology describes the storage of the installed machine as it was actually built.
+type Topology struct {
+	Disks           []TopologyDisk           `json:"disks"`
+	Raids           []TopologyRaid           `json:"raids"`
+	PhysicalVolumes []TopologyPhysicalVolume `json:"physicalvolumes"`
+	VolumeGroups    []TopologyVolumeGroup    `json:"volumegroups"`
+	LogicalVolumes  []TopologyLogicalVolume  `json:"logicalvolumes"`
+	ZPools          []string                 `json:"zpools"`
+	Filesystems     []TopologyFilesystem     `json:"filesystems"`
+}
+
+// TopologyDisk is a disk with its partition table
+type TopologyDisk struct {
+	Device         string              `json:"device"`
+	PartitionTable string              `json:"partitiontable"`
+	GUID           string              `json:"guid"`
+	Partitions     []TopologyPartition `json:"partitions"`
+}
+
+// TopologyPartition is a partition of a disk, start and size are in bytes
+type TopologyPartition struct {
+	Device string `json:"device"`
+	Number int    `json:"number"`
+	Label  string `json:"label"`
+	GUID   string `json:"guid"`
+	Start  uint64 `json:"start"`
+	Size   uint64 `json:"size"`
+}
+
+// TopologyRaid is a md array with its state from /proc/mdstat
+type TopologyRaid struct {
+	Name    string   `json:"name"`
+	Device  string   `json:"device"`
+	UUID    string   `json:"uuid"`
+	Level   string   `json:"level"`
+	State   string   `json:"state"`
+	Devices []string `json:"devices"`
+	// Sync is the running sync operation, e.g. resync or recovery, empty if the array is in sync
+	Sync string `json:"sync,omitempty"`
+	// SyncProgress of the running sync operation in percent
+	SyncProgress float64 `json:"syncprogress,omitempty"`
+}
+
+// TopologyPhysicalVolume is a lvm physical volume, sizes are in bytes
+type TopologyPhysicalVolume struct {
+	Device      string `json:"device"`
+	VolumeGroup string `json:"volumegroup"`
+	Size        uint64 `json:"size"`
+	Free        uint64 `json:"free"`
+}
+
+// TopologyVolumeGroup is a lvm volume group, sizes are in bytes
+type TopologyVolumeGroup struct {
+	Name            string `json:"name"`
+	Size            uint64 `json:"size"`
+	Free            uint64 `json:"free"`
+	PhysicalVolumes int    `json:"physicalvolumes"`
+}
+
+// TopologyLogicalVolume is a lvm logical volume, the size is in bytes
+type TopologyLogicalVolume struct {
+	Name        string `json:"name"`
+	VolumeGroup string `json:"volumegroup"`
+	Size        uint64 `json:"size"`
+	Type        string `json:"type"`
+	Devices     string `json:"devices"`
+}
+
+// TopologyFilesystem is a created filesystem with its mountpoint in the target os
+type TopologyFilesystem struct {
+	Device     string   `json:"device"`
+	Format     string   `json:"format"`
+	Label      string   `json:"label"`
+	UUID       string   `json:"uuid"`
+	Mountpoint string   `json:"mountpoint"`
+	Options    []string `json:"options"`
+}
+
+// mdstatArray is an array parsed from /proc/mdstat
+type mdstatArray struct {
+	device       string
+	state        string
+	level        string
+	devices      []string
+	sync         string
+	syncProgress float64
+}
+
+var (
+	mdstatArrayLine    = regexp.MustCompile(`^(md\S+) : (\S+)(?: \([^)]*\))?((?: \S+)*)$`)
+	mdstatProgressLine = regexp.MustCompile(`(resync|recovery|reshape|check)\s*=\s*([0-9.]+)%`)
+	mdstatMember       = regexp.MustCompile(`^([^\[]+)\[\d+\]`)
+)
+
+// parseMDStat parses /proc/mdstat:
+//
+//	md127 : active raid1 sdb2[1] sda2[0]
+//	      1046528 blocks super 1.2 [2/2] [UU]
+//	      [==>..................]  resync = 12.6% (132096/1046528) finish=0.5min speed=26419K/sec
+func parseMDStat(r io.Reader) ([]mdstatArray, error) {
+	result := []mdstatArray{}
+	var current *mdstatArray
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := mdstatArrayLine.FindStringSubmatch(line); m != nil {
+			result = append(result, mdstatArray{device: m[1], state: m[2], devices: []string{}})
+			current = &result[len(result)-1]
+			for _, field := range strings.Fields(m[3]) {
+				if member := mdstatMember.FindStringSubmatch(field); member != nil {
+					current.devices = append(current.devices, member[1])
+				} else if current.level == "" {
+					current.level = field
+				}
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if m := mdstatProgressLine.FindStringSubmatch(line); m != nil {
+			current.sync = m[1]
+			current.syncProgress, _ = strconv.ParseFloat(m[2], 64)
+		}
+		if strings.TrimSpace(line) == "" {
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to parse %s %w", mdstat, err)
+	}
+	return result, nil
+}
+
+// parseLVMReport returns all rows of the given kind, e.g. pv, from the output of lvm with --reportformat json.
+func parseLVMReport(out []byte, kind string) ([]map[string]string, error) {
+	report := struct {
+		Report []map[string][]map[string]string `json:"report"`
+	}{}
+	err := json.Unmarshal(out, &report)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse lvm report %w", err)
+	}
+	result := []map[string]string{}
+	for _, r := range report.Report {
+		result = append(result, r[kind]...)
+	}
+	return result, nil
+}
+
+func lvmReport(kind string, fields string) ([]map[string]string, error) {
+	path, err := exec.LookPath(command.LVM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate program:%s in path %w", command.LVM, err)
+	}
+	//nolint:gosec
+	out, err := exec.Command(path, kind+"s", "--reportformat", "json", "--units", "b", "--nosuffix", "-o", fields).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %ss %w", kind, err)
+	}
+	return parseLVMReport(out, kind)
+}
+
+func parseBytes(value string) uint64 {
+	result, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	return result
+}
+
+// readPartitions reads the partitions of the given disk from sysfs and blkid.
+func readPartitions(device string) ([]TopologyPartition, error) {
+	name := filepath.Base(device)
+	entries, err := gos.ReadDir(filepath.Join(sysClassBlock, name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read partitions of %s %w", device, err)
+	}
+	result := []TopologyPartition{}
+	for _, e := range entries {
+		read := func(attribute string) string {
+			content, err := gos.ReadFile(filepath.Join(sysClassBlock, name, e.Name(), attribute))
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSpace(string(content))
+		}
+		number, err := strconv.Atoi(read("partition"))
+		if err != nil {
+			continue
+		}
+		p := TopologyPartition{
+			Device: "/dev/" + e.Name(),
+			Number: number,
+			// start and size are always reported in 512 byte sectors
+			Start: parseBytes(read("start")) * 512,
+			Size:  parseBytes(read("size")) * 512,
+		}
+		props, err := FetchBlockIDProperties(p.Device)
+		if err == nil {
+			p.Label = props["PARTLABEL"]
+			p.GUID = props["PARTUUID"]
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// Topology collects the storage topology which was built, failures of single parts are logged
+// to report as much as possible.
+func (f *Filesystem) Topology() *Topology {
+	t := &Topology{
+		Disks:           []TopologyDisk{},
+		Raids:           []TopologyRaid{},
+		PhysicalVolumes: []TopologyPhysicalVolume{},
+		VolumeGroups:    []TopologyVolumeGroup{},
+		LogicalVolumes:  []TopologyLogicalVolume{},
+		ZPools:          append([]string{}, f.zpools...),
+		Filesystems:     []TopologyFilesystem{},
+	}
+
+	devices := []string{}
+	for _, disk := range f.config.Disks {
+		if disk.Device != nil {
+			devices = append(devices, *disk.Device)
+		}
+	}
+	if f.config.Rawimage != nil && f.config.Rawimage.Device != nil {
+		devices = append(devices, *f.config.Rawimage.Device)
+	}
+	for _, device := range devices {
+		d := TopologyDisk{Device: device}
+		props, err := FetchBlockIDProperties(device)
+		if err == nil {
+			d.PartitionTable = props["PTTYPE"]
+			d.GUID = props["PTUUID"]
+		}
+		d.Partitions, err = readPartitions(device)
+		if err != nil {
+			log.Error("topology", "error", err)
+		}
+		t.Disks = append(t.Disks, d)
+	}
+
+	t.Raids = f.raidTopology()
+
+	if len(f.config.Volumegroups) > 0 {
+		pvs, err := lvmReport("pv", "pv_name,vg_name,pv_size,pv_free")
+		if err != nil {
+			log.Error("topology", "error", err)
+		}
+		for _, pv := range pvs {
+			t.PhysicalVolumes = append(t.PhysicalVolumes, TopologyPhysicalVolume{
+				Device: pv["pv_name"], VolumeGroup: pv["vg_name"], Size: parseBytes(pv["pv_size"]), Free: parseBytes(pv["pv_free"]),
+			})
+		}
+		vgs, err := lvmReport("vg", "vg_name,vg_size,vg_free,pv_count")
+		if err != nil {
+			log.Error("topology", "error", err)
+		}
+		for _, vg := range vgs {
+			pvCount, _ := strconv.Atoi(vg["pv_count"])
+			t.VolumeGroups = append(t.VolumeGroups, TopologyVolumeGroup{
+				Name: vg["vg_name"], Size: parseBytes(vg["vg_size"]), Free: parseBytes(vg["vg_free"]), PhysicalVolumes: pvCount,
+			})
+		}
+		lvs, err := lvmReport("lv", "lv_name,vg_name,lv_size,segtype,devices")
+		if err != nil {
+			log.Error("topology", "error", err)
+		}
+		for _, lv := range lvs {
+			t.LogicalVolumes = append(t.LogicalVolumes, TopologyLogicalVolume{
+				Name: lv["lv_name"], VolumeGroup: lv["vg_name"], Size: parseBytes(lv["lv_size"]), Type: lv["segtype"], Devices: lv["devices"],
+			})
+		}
+	}
+
+	for _, fs := range f.config.Filesystems {
+		if fs.Format == nil || fs.Device == nil || f.skipFilesystem(fs, false) {
+			continue
+		}
+		tf := TopologyFilesystem{
+			Device:     *fs.Device,
+			Format:     *fs.Format,
+			Label:      fs.Label,
+			Mountpoint: fs.Path,
+			Options:    fs.Mountoptions,
+		}
+		switch *fs.Format {
+		case "tmpfs", "none":
+		default:
+			props, err := FetchBlockIDProperties(*fs.Device)
+			if err != nil {
+				log.Error("topology", "error", err)
+			}
+			tf.UUID = props["UUID"]
+		}
+		t.Filesystems = append(t.Filesystems, tf)
+	}
+	return t
+}
+
+// raidTopology combines the created arrays with their state from /proc/mdstat.
+func (f *Filesystem) raidTopology() []TopologyRaid {
+	result := []TopologyRaid{}
+	if len(f.raidArrays) == 0 {
+		return result
+	}
+	file, err := gos.Open(mdstat)
+	if err != nil {
+		log.Error("topology", "error", err)
+		return result
+	}
+	defer file.Close()
+	arrays, err := parseMDStat(file)
+	if err != nil {
+		log.Error("topology", "error", err)
+		return result
+	}
+	states := make(map[string]mdstatArray)
+	for _, a := range arrays {
+		states[a.device] = a
+	}
+	for _, a := range f.raidArrays {
+		r := TopologyRaid{Name: a.Name, UUID: a.UUID, Level: a.Level, Devices: []string{}}
+		device, err := filepath.EvalSymlinks(a.Name)
+		if err == nil {
+			r.Device = device
+			if state, ok := states[filepath.Base(device)]; ok {
+				r.State = state.state
+				r.Devices = state.devices
+				r.Sync = state.sync
+				r.SyncProgress = state.syncProgress
+			}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// CreateStorageJSON writes the storage topology to /etc/metal/storage.json in the target os and returns it.
+func (f *Filesystem) CreateStorageJSON() (*Topology, error) {
+	configdir := path.Join(f.chroot, "etc", "metal")
+	destination := path.Join(configdir, "storage.json")
+
+	err := gos.MkdirAll(configdir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	t := f.Topology()
+	j, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal to json %w", err)
+	}
+	log.Info("create storage.json", "content", string(j))
+	err = gos.WriteFile(destination, j, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write storage.json %w", err)
+	}
+	return t, nil
+}
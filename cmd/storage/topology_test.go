@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const procMDStat = `Personalities : [raid1] [raid6] [raid5] [raid4]
+md126 : active (auto-read-only) raid5 sdd1[2] sdc1[1] sdb1[0] sde1[3](S)
+      2093056 blocks super 1.2 level 5, 512k chunk, algorithm 2 [3/3] [UUU]
+
+md127 : active raid1 sdb2[1] sda2[0]
+      1046528 blocks super 1.2 [2/2] [UU]
+      [==>..................]  resync = 12.6% (132096/1046528) finish=0.5min speed=26419K/sec
+
+unused devices: <none>
+`
+
+func TestParseMDStat(t *testing.T) {
+	got, err := parseMDStat(strings.NewReader(procMDStat))
+	if err != nil {
+		t.Fatalf("parseMDStat() error = %v", err)
+	}
+	want := []mdstatArray{
+		{device: "md126", state: "active", level: "raid5", devices: []string{"sdd1", "sdc1", "sdb1", "sde1"}},
+		{device: "md127", state: "active", level: "raid1", devices: []string{"sdb2", "sda2"}, sync: "resync", syncProgress: 12.6},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMDStat() = %v, want %v", got, want)
+	}
+}
+
+func TestParseLVMReport(t *testing.T) {
+	out := `  {
+      "report": [
+          {
+              "pv": [
+                  {"pv_name":"/dev/sda3", "vg_name":"vg00", "pv_size":"10733223936", "pv_free":"0"},
+                  {"pv_name":"/dev/sdb3", "vg_name":"vg00", "pv_size":"10733223936", "pv_free":"4194304"}
+              ]
+          }
+      ]
+  }`
+	got, err := parseLVMReport([]byte(out), "pv")
+	if err != nil {
+		t.Fatalf("parseLVMReport() error = %v", err)
+	}
+	want := []map[string]string{
+		{"pv_name": "/dev/sda3", "vg_name": "vg00", "pv_size": "10733223936", "pv_free": "0"},
+		{"pv_name": "/dev/sdb3", "vg_name": "vg00", "pv_size": "10733223936", "pv_free": "4194304"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLVMReport() = %v, want %v", got, want)
+	}
+
+	got, err = parseLVMReport([]byte(out), "vg")
+	if err != nil || len(got) != 0 {
+		t.Errorf("parseLVMReport() = %v, %v, want no rows", got, err)
+	}
+
+	_, err = parseLVMReport([]byte("  Volume group not found"), "vg")
+	if err == nil {
+		t.Errorf("parseLVMReport() expected error for invalid output")
+	}
+}
+
+func TestReadPartitions(t *testing.T) {
+	dir := t.TempDir()
+	old := sysClassBlock
+	sysClassBlock = dir
+	defer func() { sysClassBlock = old }()
+
+	files := map[string]string{
+		"nvme0n1/size":                     "2097152",
+		"nvme0n1/nvme0n1p1/partition":      "1",
+		"nvme0n1/nvme0n1p1/start":          "2048",
+		"nvme0n1/nvme0n1p1/size":           "1048576",
+		"nvme0n1/nvme0n1p2/partition":      "2",
+		"nvme0n1/nvme0n1p2/start":          "1050624",
+		"nvme0n1/nvme0n1p2/size":           "1044480",
+		"nvme0n1/queue/logical_block_size": "512",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(file, []byte(content+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := readPartitions("/dev/nvme0n1")
+	if err != nil {
+		t.Fatalf("readPartitions() error = %v", err)
+	}
+	want := []TopologyPartition{
+		{Device: "/dev/nvme0n1p1", Number: 1, Start: 2048 * 512, Size: 1048576 * 512},
+		{Device: "/dev/nvme0n1p2", Number: 2, Start: 1050624 * 512, Size: 1044480 * 512},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readPartitions() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"fmt"
+	gos "os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/v"
+)
+
+const systemdUnitDir = "/etc/systemd/system"
+
+// writeUnits writes a systemd mount or swap unit for every entry and enables it.
+// The root filesystem is still written to /etc/fstab, because it is mounted by the initramfs
+// and systemd-remount-fs reads its options from there.
+func (fss fstabEntries) writeUnits(chroot string) error {
+	unitDir := path.Join(chroot, systemdUnitDir)
+	err := gos.MkdirAll(unitDir, 0755)
+	if err != nil {
+		return err
+	}
+	root := fstabEntries{}
+	for _, fs := range fss {
+		if fs.file == "/" {
+			root = append(root, fs)
+			continue
+		}
+		name, content := fs.unit()
+		log.Info("write systemd unit", "name", name, "content", content)
+		//nolint:gosec
+		err := gos.WriteFile(path.Join(unitDir, name), []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write unit %s %w", name, err)
+		}
+		err = enableUnit(unitDir, name, fs.wantedBy())
+		if err != nil {
+			return err
+		}
+	}
+	return root.write(chroot)
+}
+
+// enableUnit does the same as systemctl enable for a unit which is wanted by the given target.
+func enableUnit(unitDir, name, target string) error {
+	wants := path.Join(unitDir, target+".wants")
+	err := gos.MkdirAll(wants, 0755)
+	if err != nil {
+		return err
+	}
+	link := path.Join(wants, name)
+	_ = gos.Remove(link)
+	err = gos.Symlink(path.Join(systemdUnitDir, name), link)
+	if err != nil {
+		return fmt.Errorf("unable to enable unit %s %w", name, err)
+	}
+	return nil
+}
+
+func (fs fstabEntry) isSwap() bool {
+	return fs.vfsType == "swap"
+}
+
+func (fs fstabEntry) wantedBy() string {
+	if fs.isSwap() {
+		return "swap.target"
+	}
+	return "local-fs.target"
+}
+
+// what returns the device of the entry as path, systemd units do not understand the UUID= notation.
+func (fs fstabEntry) what() string {
+	if strings.HasPrefix(fs.spec, "UUID=") {
+		return "/dev/disk/by-uuid/" + strings.TrimPrefix(fs.spec, "UUID=")
+	}
+	return fs.spec
+}
+
+// unit returns the name and the content of the systemd unit of this entry, see man 5 systemd.mount and systemd.swap.
+func (fs fstabEntry) unit() (string, string) {
+	what := fs.what()
+	lines := []string{fmt.Sprintf("# created by metal-hammer: %q", v.V), "[Unit]"}
+
+	if fs.isSwap() {
+		name := escapeUnitPath(what) + ".swap"
+		lines = append(lines, "Description=Swap "+what, "", "[Swap]", "What="+what)
+		options := []string{}
+		for _, o := range fs.mountOpts {
+			switch {
+			case strings.HasPrefix(o, "pri="):
+				lines = append(lines, "Priority="+strings.TrimPrefix(o, "pri="))
+			case o == "sw" || o == "defaults":
+				// implicit for swap units
+			default:
+				options = append(options, o)
+			}
+		}
+		if len(options) > 0 {
+			lines = append(lines, "Options="+strings.Join(options, ","))
+		}
+		lines = append(lines, "", "[Install]", "WantedBy="+fs.wantedBy())
+		return name, strings.Join(lines, "\n") + "\n"
+	}
+
+	name := escapeUnitPath(fs.file) + ".mount"
+	lines = append(lines, "Description=Mount "+fs.file)
+	if fs.passno > 0 && strings.HasPrefix(what, "/dev/") {
+		fsck := fmt.Sprintf("systemd-fsck@%s.service", escapeUnitPath(what))
+		lines = append(lines, "Requires="+fsck, "After="+fsck)
+	}
+	lines = append(lines, "", "[Mount]", "What="+what, "Where="+fs.file, "Type="+fs.vfsType)
+	if len(fs.mountOpts) > 0 {
+		lines = append(lines, "Options="+strings.Join(fs.mountOpts, ","))
+	}
+	lines = append(lines, "", "[Install]", "WantedBy="+fs.wantedBy())
+	return name, strings.Join(lines, "\n") + "\n"
+}
+
+// escapeUnitPath escapes a path like systemd-escape --path does.
+func escapeUnitPath(p string) string {
+	p = strings.Trim(filepath.Clean(p), "/")
+	if p == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// zramConfig renders the configuration of the systemd zram-generator, see man 5 zram-generator.conf.
+func zramConfig(zram []*models.ModelsV1Zram) string {
+	lines := []string{fmt.Sprintf("# created by metal-hammer: %q", v.V)}
+	for i, z := range zram {
+		if z.Size == nil {
+			continue
+		}
+		lines = append(lines, "", fmt.Sprintf("[zram%d]", i), "zram-size = "+*z.Size)
+		if z.Algorithm != "" {
+			lines = append(lines, "compression-algorithm = "+z.Algorithm)
+		}
+		if z.Priority > 0 {
+			lines = append(lines, fmt.Sprintf("swap-priority = %d", z.Priority))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writeZramConfig writes the zram swap devices into the target os, they are created by the zram-generator during boot.
+func writeZramConfig(chroot string, zram []*models.ModelsV1Zram) error {
+	if len(zram) == 0 {
+		return nil
+	}
+	configDir := path.Join(chroot, "etc", "systemd")
+	err := gos.MkdirAll(configDir, 0755)
+	if err != nil {
+		return err
+	}
+	content := zramConfig(zram)
+	destination := path.Join(configDir, "zram-generator.conf")
+	log.Info("write zram-generator.conf", "path", destination, "content", content)
+	//nolint:gosec
+	err = gos.WriteFile(destination, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write zram-generator.conf %w", err)
+	}
+	return nil
+}
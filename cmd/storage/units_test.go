@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func TestEscapeUnitPath(t *testing.T) {
+	tests := map[string]string{
+		"/":                                "-",
+		"/var/lib":                         "var-lib",
+		"/var/lib/":                        "var-lib",
+		"/.snapshots":                      `\x2esnapshots`,
+		"/dev/disk/by-uuid/1234-abcd":      `dev-disk-by\x2duuid-1234\x2dabcd`,
+		"/srv/my data":                     `srv-my\x20data`,
+		"/var/lib/containerd.io/overlay_1": "var-lib-containerd.io-overlay_1",
+	}
+	for path, want := range tests {
+		if got := escapeUnitPath(path); got != want {
+			t.Errorf("escapeUnitPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestFstabEntryUnit(t *testing.T) {
+	tests := []struct {
+		name        string
+		entry       fstabEntry
+		wantName    string
+		wantContent []string
+	}{
+		{
+			name:     "filesystem with fsck",
+			entry:    fstabEntry{spec: "UUID=42", file: "/var/lib", vfsType: "ext4", mountOpts: []string{"defaults", "noatime"}, passno: 2},
+			wantName: "var-lib.mount",
+			wantContent: []string{
+				"Requires=systemd-fsck@dev-disk-by\\x2duuid-42.service",
+				"What=/dev/disk/by-uuid/42",
+				"Where=/var/lib",
+				"Type=ext4",
+				"Options=defaults,noatime",
+				"WantedBy=local-fs.target",
+			},
+		},
+		{
+			name:     "sized tmpfs",
+			entry:    fstabEntry{spec: "tmpfs", file: "/tmp", vfsType: "tmpfs", mountOpts: []string{"defaults", "size=50%", "mode=1777"}},
+			wantName: "tmp.mount",
+			wantContent: []string{
+				"What=tmpfs",
+				"Options=defaults,size=50%,mode=1777",
+			},
+		},
+		{
+			name:     "swap with priority",
+			entry:    swapEntry("42", models.ModelsV1Filesystem{Swappriority: 10}),
+			wantName: "dev-disk-by\\x2duuid-42.swap",
+			wantContent: []string{
+				"What=/dev/disk/by-uuid/42",
+				"Priority=10",
+				"WantedBy=swap.target",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			name, content := tt.entry.unit()
+			if name != tt.wantName {
+				t.Errorf("unit() name = %q, want %q", name, tt.wantName)
+			}
+			for _, line := range tt.wantContent {
+				if !strings.Contains(content, line+"\n") {
+					t.Errorf("unit() content does not contain %q:\n%s", line, content)
+				}
+			}
+		})
+	}
+}
+
+func TestSwapEntry(t *testing.T) {
+	got := swapEntry("42", models.ModelsV1Filesystem{Swappriority: 10}).string()
+	want := "UUID=42 none swap sw,pri=10 0 0"
+	if got != want {
+		t.Errorf("swapEntry() = %q, want %q", got, want)
+	}
+}
+
+func TestZramConfig(t *testing.T) {
+	size := "ram / 2"
+	got := zramConfig([]*models.ModelsV1Zram{{Size: &size, Algorithm: "zstd", Priority: 100}})
+	want := "\n[zram0]\nzram-size = ram / 2\ncompression-algorithm = zstd\nswap-priority = 100\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("zramConfig() = %q, want suffix %q", got, want)
+	}
+}
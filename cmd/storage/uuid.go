@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// deterministicUUID returns a name based uuid which is derived from the machine uuid and the given names,
+// equal inputs result in the same uuid on every installation. Empty if the layout does not request deterministic uuids.
+func (f *Filesystem) deterministicUUID(names ...string) string {
+	if !f.config.Deterministicuuids || f.machineUUID == "" {
+		return ""
+	}
+	return deriveUUID(f.machineUUID, names...)
+}
+
+func deriveUUID(machineUUID string, names ...string) string {
+	namespace, err := uuid.Parse(machineUUID)
+	if err != nil {
+		// machine uuids are usually board serials, which are not always valid uuids
+		namespace = uuid.NewSHA1(uuid.NameSpaceOID, []byte(machineUUID))
+	}
+	return uuid.NewSHA1(namespace, []byte(strings.Join(names, "/"))).String()
+}
+
+// volumeID returns the 32 bit volume id of a vfat filesystem derived from the uuid.
+func volumeID(u string) string {
+	return strings.ToUpper(strings.ReplaceAll(u, "-", "")[:8])
+}
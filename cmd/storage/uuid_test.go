@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func TestDeriveUUID(t *testing.T) {
+	tests := []struct {
+		name        string
+		machineUUID string
+		names       []string
+		want        string
+	}{
+		{
+			name:        "machine uuid is a uuid",
+			machineUUID: "4c4c4544-0042-4810-8056-b4c04f395a32",
+			names:       []string{"partition", "/dev/sda", "1", "efi"},
+			want:        "8c033d70-12e1-5bb5-9647-63765259eb2e",
+		},
+		{
+			name:        "machine uuid is a board serial",
+			machineUUID: "S123456",
+			names:       []string{"filesystem", "/dev/sda1", "efi"},
+			want:        "32396cd2-6c27-5a06-a5c9-08c0f60795f3",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deriveUUID(tt.machineUUID, tt.names...); got != tt.want {
+				t.Errorf("deriveUUID() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeterministicUUID(t *testing.T) {
+	f := New("/rootfs", "4c4c4544-0042-4810-8056-b4c04f395a32", models.ModelsV1FilesystemLayoutResponse{})
+	if got := f.deterministicUUID("partition", "/dev/sda", "1", "efi"); got != "" {
+		t.Errorf("deterministicUUID() = %v, want no uuid if not requested by the layout", got)
+	}
+	f.config.Deterministicuuids = true
+	a := f.deterministicUUID("partition", "/dev/sda", "1", "efi")
+	b := f.deterministicUUID("partition", "/dev/sdb", "1", "efi")
+	if a == "" || a == b {
+		t.Errorf("deterministicUUID() = %v and %v, want different uuids for different partitions", a, b)
+	}
+	if got := volumeID("8c033d70-12e1-5bb5-9647-63765259eb2e"); got != "8C033D70" {
+		t.Errorf("volumeID() = %v, want 8C033D70", got)
+	}
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"fmt"
+	gos "os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+const (
+	// verityName is the device mapper name of the verity protected root filesystem
+	verityName   = "vroot"
+	verityDevice = "/dev/mapper/" + verityName
+)
+
+// Verity describes the dm-verity hash tree of a filesystem.
+type Verity struct {
+	DataDevice    string
+	HashDevice    string
+	HashAlgorithm string
+	DataBlocks    uint64
+	DataBlockSize uint64
+	HashBlockSize uint64
+	Salt          string
+	RootHash      string
+}
+
+// verityFilesystem returns the filesystem which is protected by dm-verity, only the root filesystem is supported.
+func verityFilesystem(config models.ModelsV1FilesystemLayoutResponse) (*models.ModelsV1Filesystem, error) {
+	var result *models.ModelsV1Filesystem
+	for _, fs := range config.Filesystems {
+		if fs.Verity == nil {
+			continue
+		}
+		if fs.Path != "/" {
+			return nil, fmt.Errorf("dm-verity is only supported for the root filesystem, not for %s", fs.Path)
+		}
+		if fs.Verity.Hashdevice == nil || *fs.Verity.Hashdevice == "" {
+			return nil, fmt.Errorf("dm-verity of %s requires a hash device", fs.Path)
+		}
+		result = fs
+	}
+	if result != nil && result.Verity.Roothashfile != "" {
+		err := validateRootHashFile(config, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// validateRootHashFile checks that the root hash file is located on another filesystem of the layout than the
+// verity protected root filesystem, which is read-only once the hash tree is created.
+func validateRootHashFile(config models.ModelsV1FilesystemLayoutResponse, verity *models.ModelsV1Filesystem) error {
+	file := verity.Verity.Roothashfile
+	if !path.IsAbs(file) {
+		return fmt.Errorf("dm-verity root hash file %s must be an absolute path", file)
+	}
+	file = path.Clean(file)
+	// the filesystem with the longest path containing the file stores it
+	var owner *models.ModelsV1Filesystem
+	for _, fs := range config.Filesystems {
+		if fs.Path == "" || (fs.Format != nil && *fs.Format == "swap") {
+			continue
+		}
+		if fs.Path != "/" && file != fs.Path && !strings.HasPrefix(file, fs.Path+"/") {
+			continue
+		}
+		if owner == nil || len(fs.Path) > len(owner.Path) {
+			owner = fs
+		}
+	}
+	if owner == nil || owner == verity {
+		return fmt.Errorf("dm-verity root hash file %s must be located on a writable filesystem other than the root filesystem", file)
+	}
+	if owner.Format != nil && *owner.Format == "tmpfs" {
+		return fmt.Errorf("dm-verity root hash file %s must not be located on tmpfs %s", file, owner.Path)
+	}
+	for _, option := range owner.Mountoptions {
+		if option == "ro" {
+			return fmt.Errorf("dm-verity root hash file %s must not be located on read-only filesystem %s", file, owner.Path)
+		}
+	}
+	return nil
+}
+
+// CreateVerity remounts the verity protected root filesystem read-only and creates its hash tree,
+// the root hash is stored in the configured file. Must be called after the target os is completely written.
+func (f *Filesystem) CreateVerity() error {
+	fs, err := verityFilesystem(f.config)
+	if err != nil || fs == nil {
+		return err
+	}
+	veritysetup, err := exec.LookPath(command.Veritysetup)
+	if err != nil {
+		return fmt.Errorf("layout contains a dm-verity filesystem but %s is not available %w", command.Veritysetup, err)
+	}
+
+	// install.sh might have left processes behind which keep files open for writing
+	f.killChrootProcesses()
+	log.Info("remount read-only", "path", f.chroot)
+	err = syscall.Mount("", f.chroot, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+	if err != nil {
+		return fmt.Errorf("unable to remount %s read-only %w", f.chroot, err)
+	}
+
+	hashAlgorithm := fs.Verity.Hashalgorithm
+	if hashAlgorithm == "" {
+		hashAlgorithm = "sha256"
+	}
+	args := []string{"format", "--hash", hashAlgorithm, *fs.Device, *fs.Verity.Hashdevice}
+	log.Info("create dm-verity hash tree", "args", args)
+	//nolint:gosec
+	out, err := exec.Command(veritysetup, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to create dm-verity hash tree of %s %s %w", *fs.Device, string(out), err)
+	}
+	verity, err := parseVerityFormat(string(out))
+	if err != nil {
+		return err
+	}
+	verity.DataDevice = *fs.Device
+	verity.HashDevice = *fs.Verity.Hashdevice
+	log.Info("created dm-verity hash tree", "device", verity.DataDevice, "roothash", verity.RootHash)
+	f.verity = verity
+
+	if fs.Verity.Roothashfile == "" {
+		return nil
+	}
+	return writeRootHash(f.chroot, fs.Verity.Roothashfile, verity.RootHash)
+}
+
+func writeRootHash(chroot, file, rootHash string) error {
+	destination := path.Join(chroot, file)
+	err := gos.MkdirAll(path.Dir(destination), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create directory of %s %w", file, err)
+	}
+	//nolint:gosec
+	err = gos.WriteFile(destination, []byte(rootHash+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write root hash to %s, it must be on a writable filesystem %w", file, err)
+	}
+	return nil
+}
+
+// parseVerityFormat parses the output of veritysetup format:
+//
+//	VERITY header information for /dev/sda3
+//	UUID:            	2a7c3d0e-5bbf-4b2e-a4b5-2a0c3b8e2f11
+//	Hash type:       	1
+//	Data blocks:     	262144
+//	Data block size: 	4096
+//	Hash block size: 	4096
+//	Hash algorithm:  	sha256
+//	Salt:            	9d2c...
+//	Root hash:      	4f1a...
+func parseVerityFormat(out string) (*Verity, error) {
+	props := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		keyValue := strings.SplitN(line, ":", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		props[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	v := &Verity{
+		HashAlgorithm: props["Hash algorithm"],
+		Salt:          props["Salt"],
+		RootHash:      props["Root hash"],
+	}
+	if v.RootHash == "" {
+		return nil, fmt.Errorf("no root hash found in output of veritysetup")
+	}
+	var err error
+	for key, value := range map[string]*uint64{
+		"Data blocks":     &v.DataBlocks,
+		"Data block size": &v.DataBlockSize,
+		"Hash block size": &v.HashBlockSize,
+	} {
+		*value, err = strconv.ParseUint(props[key], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s of veritysetup %w", key, err)
+		}
+	}
+	return v, nil
+}
+
+// KernelCmdline returns the given kernel command line with the dm-verity parameters of the root filesystem,
+// the kernel creates the verity device itself and uses it as root device, see
+// https://docs.kernel.org/admin-guide/device-mapper/dm-init.html
+func (f *Filesystem) KernelCmdline(cmdline string) string {
+	if f.verity == nil {
+		return cmdline
+	}
+	return verityCmdline(cmdline, f.verity)
+}
+
+func verityCmdline(cmdline string, v *Verity) string {
+	sectors := v.DataBlocks * v.DataBlockSize / 512
+	table := fmt.Sprintf("%s,,,ro,0 %d verity 1 %s %s %d %d %d 1 %s %s %s",
+		verityName, sectors, v.DataDevice, v.HashDevice, v.DataBlockSize, v.HashBlockSize, v.DataBlocks, v.HashAlgorithm, v.RootHash, v.Salt)
+
+	params := []string{}
+	for _, p := range strings.Fields(cmdline) {
+		if strings.HasPrefix(p, "root=") || p == "rw" {
+			continue
+		}
+		params = append(params, p)
+	}
+	params = append(params, fmt.Sprintf("dm-mod.create=%q", table), "root=/dev/dm-0", "ro")
+	return strings.Join(params, " ")
+}
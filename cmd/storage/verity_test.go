@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+const veritysetupFormat = `VERITY header information for /dev/sda3
+UUID:            	2a7c3d0e-5bbf-4b2e-a4b5-2a0c3b8e2f11
+Hash type:       	1
+Data blocks:     	262144
+Data block size: 	4096
+Hash block size: 	4096
+Hash algorithm:  	sha256
+Salt:            	9d2c6f
+Root hash:      	4f1a0b
+`
+
+func TestParseVerityFormat(t *testing.T) {
+	got, err := parseVerityFormat(veritysetupFormat)
+	if err != nil {
+		t.Fatalf("parseVerityFormat() error = %v", err)
+	}
+	want := &Verity{
+		HashAlgorithm: "sha256",
+		DataBlocks:    262144,
+		DataBlockSize: 4096,
+		HashBlockSize: 4096,
+		Salt:          "9d2c6f",
+		RootHash:      "4f1a0b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseVerityFormat() = %v, want %v", got, want)
+	}
+
+	_, err = parseVerityFormat("Device /dev/sda3 is too small.")
+	if err == nil {
+		t.Errorf("parseVerityFormat() expected error for output without root hash")
+	}
+}
+
+func TestVerityCmdline(t *testing.T) {
+	v, err := parseVerityFormat(veritysetupFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.DataDevice = "/dev/sda3"
+	v.HashDevice = "/dev/sda4"
+
+	got := verityCmdline("console=ttyS1,115200n8 root=UUID=42 rw init=/sbin/init", v)
+	want := `console=ttyS1,115200n8 init=/sbin/init dm-mod.create="vroot,,,ro,0 2097152 verity 1 /dev/sda3 /dev/sda4 4096 4096 262144 1 sha256 4f1a0b 9d2c6f" root=/dev/dm-0 ro`
+	if got != want {
+		t.Errorf("verityCmdline() = %q, want %q", got, want)
+	}
+}
+
+func TestVerityFilesystem(t *testing.T) {
+	ext4, tmpfs, sda2, sda3, sda4, sda5 := "ext4", "tmpfs", "/dev/sda2", "/dev/sda3", "/dev/sda4", "/dev/sda5"
+	layout := func(roothashfile string, varOptions ...string) models.ModelsV1FilesystemLayoutResponse {
+		return models.ModelsV1FilesystemLayoutResponse{
+			Filesystems: []*models.ModelsV1Filesystem{
+				{Path: "/", Device: &sda3, Format: &ext4, Verity: &models.ModelsV1Verity{Hashdevice: &sda4, Roothashfile: roothashfile}},
+				{Path: "/var", Device: &sda5, Format: &ext4, Mountoptions: varOptions},
+				{Path: "/etc/metal", Device: &sda2, Format: &ext4},
+				{Path: "/tmp", Format: &tmpfs},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		config  models.ModelsV1FilesystemLayoutResponse
+		wantErr bool
+	}{
+		{name: "no root hash file", config: layout("")},
+		{name: "root hash file on writable filesystem", config: layout("/var/lib/metal/roothash")},
+		{name: "root hash file on nested filesystem", config: layout("/etc/metal/roothash")},
+		{name: "root hash file on root filesystem", config: layout("/etc/roothash"), wantErr: true},
+		{name: "root hash file on similar path", config: layout("/variable/roothash"), wantErr: true},
+		{name: "root hash file on read-only filesystem", config: layout("/var/roothash", "noatime", "ro"), wantErr: true},
+		{name: "root hash file on tmpfs", config: layout("/tmp/roothash"), wantErr: true},
+		{name: "relative root hash file", config: layout("var/roothash"), wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := verityFilesystem(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verityFilesystem() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && fs != tt.config.Filesystems[0] {
+				t.Errorf("verityFilesystem() = %v, want the root filesystem", fs)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	gos "os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+	"github.com/metal-stack/metal-hammer/pkg/os"
+	"github.com/metal-stack/metal-hammer/pkg/os/command"
+)
+
+// zpoolCache is written during pool creation and copied into the target os, it is used by zfs-import-cache
+// to import the pools during boot.
+const zpoolCache = "/etc/zfs/zpool.cache"
+
+// zfsModule is present if the zfs module is loaded or built into the kernel
+var zfsModule = "/sys/module/zfs"
+
+// minVdevDevices is the minimum number of devices of a vdev type
+var minVdevDevices = map[string]int{
+	"":       1,
+	"mirror": 2,
+	"raidz1": 2,
+	"raidz2": 3,
+	"raidz3": 4,
+}
+
+var vdevClasses = map[string]bool{
+	"":        true,
+	"special": true,
+	"dedup":   true,
+	"log":     true,
+	"cache":   true,
+	"spare":   true,
+}
+
+// zpoolCreateArgs returns the arguments of zpool create, the pool is created with the chroot as alternate root,
+// therefore all mountpoints are relative to the target os.
+func zpoolCreateArgs(pool *models.ModelsV1ZPool, chroot string) ([]string, error) {
+	if pool.Name == nil || *pool.Name == "" {
+		return nil, fmt.Errorf("zpool without name")
+	}
+	args := []string{"create", "-f", "-R", chroot, "-o", "cachefile=" + zpoolCache}
+	for _, o := range pool.Options {
+		args = append(args, "-o", o)
+	}
+	if rootMountpoint(pool) == "" {
+		args = append(args, "-O", "mountpoint=none")
+	}
+	for _, o := range pool.Filesystemoptions {
+		args = append(args, "-O", o)
+	}
+	args = append(args, *pool.Name)
+
+	data := 0
+	for _, vdev := range pool.Vdevs {
+		minDevices, ok := minVdevDevices[vdev.Type]
+		if !ok {
+			return nil, fmt.Errorf("unsupported vdev type:%s in zpool %s", vdev.Type, *pool.Name)
+		}
+		if !vdevClasses[vdev.Class] {
+			return nil, fmt.Errorf("unsupported vdev class:%s in zpool %s", vdev.Class, *pool.Name)
+		}
+		if (vdev.Class == "cache" || vdev.Class == "spare") && vdev.Type != "" {
+			return nil, fmt.Errorf("vdev class:%s in zpool %s does not support type:%s", vdev.Class, *pool.Name, vdev.Type)
+		}
+		if len(vdev.Devices) < minDevices {
+			return nil, fmt.Errorf("vdev type:%s in zpool %s requires at least %d devices, got %d", vdev.Type, *pool.Name, minDevices, len(vdev.Devices))
+		}
+		if vdev.Class == "" {
+			data++
+		} else {
+			args = append(args, vdev.Class)
+		}
+		if vdev.Type != "" {
+			args = append(args, vdev.Type)
+		}
+		args = append(args, vdev.Devices...)
+	}
+	if data == 0 {
+		return nil, fmt.Errorf("zpool %s has no data vdev", *pool.Name)
+	}
+	return args, nil
+}
+
+// rootMountpoint returns the mountpoint of the root dataset of the pool if given.
+func rootMountpoint(pool *models.ModelsV1ZPool) string {
+	for _, o := range pool.Filesystemoptions {
+		if strings.HasPrefix(o, "mountpoint=") {
+			return strings.TrimPrefix(o, "mountpoint=")
+		}
+	}
+	return ""
+}
+
+// sortedDatasets returns the datasets of the pool with parents before their children.
+func sortedDatasets(pool *models.ModelsV1ZPool) []*models.ModelsV1ZFSDataset {
+	datasets := []*models.ModelsV1ZFSDataset{}
+	for _, ds := range pool.Datasets {
+		if ds.Name != nil && *ds.Name != "" {
+			datasets = append(datasets, ds)
+		}
+	}
+	sort.SliceStable(datasets, func(i, j int) bool {
+		return strings.Count(*datasets[i].Name, "/") < strings.Count(*datasets[j].Name, "/")
+	})
+	return datasets
+}
+
+// zfsCreateArgs returns the arguments of zfs create, the dataset is not mounted because
+// datasets are mounted together with all other filesystems in the right order.
+func zfsCreateArgs(pool string, ds *models.ModelsV1ZFSDataset) []string {
+	args := []string{"create", "-u"}
+	if ds.Mountpoint != "" {
+		args = append(args, "-o", "mountpoint="+ds.Mountpoint)
+	}
+	for _, p := range ds.Properties {
+		args = append(args, "-o", p)
+	}
+	return append(args, pool+"/"+*ds.Name)
+}
+
+// datasetMountpoints returns the effective mountpoint of all datasets keyed by their full name,
+// datasets without mountpoint inherit it from their parent like zfs does.
+// Datasets which are not mounted are omitted.
+func datasetMountpoints(pool *models.ModelsV1ZPool) map[string]string {
+	mountpoints := map[string]string{*pool.Name: rootMountpoint(pool)}
+	result := make(map[string]string)
+	if m := rootMountpoint(pool); m != "" && m != "none" && m != "legacy" {
+		result[*pool.Name] = m
+	}
+	for _, ds := range sortedDatasets(pool) {
+		name := *pool.Name + "/" + *ds.Name
+		mountpoint := ds.Mountpoint
+		if mountpoint == "" {
+			parent := path.Dir(name)
+			if m, ok := mountpoints[parent]; ok && m != "" && m != "none" && m != "legacy" {
+				mountpoint = path.Join(m, path.Base(name))
+			}
+		}
+		mountpoints[name] = mountpoint
+		if mountpoint == "" || mountpoint == "none" || mountpoint == "legacy" {
+			continue
+		}
+		canmount := true
+		for _, p := range ds.Properties {
+			if p == "canmount=off" || p == "canmount=noauto" {
+				canmount = false
+			}
+		}
+		if canmount {
+			result[name] = mountpoint
+		}
+	}
+	return result
+}
+
+// checkZFS rejects a layout with zfs pools before any disk is modified if the zfs tools or the zfs kernel module are missing.
+func checkZFS(config models.ModelsV1FilesystemLayoutResponse) error {
+	if len(config.Zpools) == 0 {
+		return nil
+	}
+	for _, c := range []string{command.ZPool, command.ZFS} {
+		if _, err := exec.LookPath(c); err != nil {
+			return fmt.Errorf("layout contains zfs pools but %s is not available %w", c, err)
+		}
+	}
+	if _, err := gos.Stat(zfsModule); err != nil {
+		return fmt.Errorf("layout contains zfs pools but the kernel does not provide zfs %w", err)
+	}
+	return nil
+}
+
+// createZPools creates all zfs pools and their datasets.
+func (f *Filesystem) createZPools() error {
+	if len(f.config.Zpools) == 0 {
+		return nil
+	}
+	err := gos.MkdirAll(path.Dir(zpoolCache), 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, pool := range f.config.Zpools {
+		args, err := zpoolCreateArgs(pool, f.chroot)
+		if err != nil {
+			return err
+		}
+		log.Info("create zpool", "args", args)
+		err = os.ExecuteCommand(command.ZPool, args...)
+		if err != nil {
+			log.Error("create zpool failed", "pool", *pool.Name, "error", err)
+			return fmt.Errorf("unable to create zpool %s %w", *pool.Name, err)
+		}
+		f.zpools = append(f.zpools, *pool.Name)
+		f.trackZPool(*pool.Name, false)
+
+		for _, ds := range sortedDatasets(pool) {
+			args := zfsCreateArgs(*pool.Name, ds)
+			log.Info("create zfs dataset", "args", args)
+			err = os.ExecuteCommand(command.ZFS, args...)
+			if err != nil {
+				log.Error("create zfs dataset failed", "dataset", *ds.Name, "error", err)
+				return fmt.Errorf("unable to create zfs dataset %s/%s %w", *pool.Name, *ds.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// importZPools imports the existing pools of a previous installation, they were exported on another host
+// from the view of zfs and must be imported with force.
+func (f *Filesystem) importZPools() error {
+	for _, pool := range f.config.Zpools {
+		if pool.Name == nil || *pool.Name == "" {
+			continue
+		}
+		log.Info("import zpool", "pool", *pool.Name)
+		err := os.ExecuteCommand(command.ZPool, "import", "-f", "-N", "-R", f.chroot, "-o", "cachefile="+zpoolCache, *pool.Name)
+		if err != nil {
+			return fmt.Errorf("unable to import zpool %s %w", *pool.Name, err)
+		}
+		f.zpools = append(f.zpools, *pool.Name)
+		f.trackZPool(*pool.Name, true)
+	}
+	return nil
+}
+
+// zfsFilesystems returns all datasets which must be mounted as filesystems with format zfs,
+// the device is the full name of the dataset.
+func (f *Filesystem) zfsFilesystems() []models.ModelsV1Filesystem {
+	result := []models.ModelsV1Filesystem{}
+	for _, pool := range f.config.Zpools {
+		if pool.Name == nil {
+			continue
+		}
+		for name, mountpoint := range datasetMountpoints(pool) {
+			name := name
+			format := "zfs"
+			result = append(result, models.ModelsV1Filesystem{Device: &name, Format: &format, Path: mountpoint})
+		}
+	}
+	return result
+}
+
+// mountZFS mounts the dataset at its mountpoint below the alternate root of the pool,
+// the root dataset of a pool is already mounted by zpool create.
+func mountZFS(chroot string, fs models.ModelsV1Filesystem) (string, error) {
+	target := path.Join(chroot, fs.Path)
+	mounted, err := isMounted(target)
+	if err != nil {
+		return "", err
+	}
+	if mounted {
+		return target, nil
+	}
+	log.Info("mount zfs dataset", "dataset", *fs.Device, "path", fs.Path)
+	err = os.ExecuteCommand(command.ZFS, "mount", *fs.Device)
+	if err != nil {
+		return "", fmt.Errorf("unable to mount zfs dataset %s %w", *fs.Device, err)
+	}
+	return target, nil
+}
+
+// CreateZFSConfig copies the zpool.cache into the target os to import all pools during boot.
+// Must be called after the image was extracted.
+func (f *Filesystem) CreateZFSConfig() error {
+	if len(f.zpools) == 0 {
+		return nil
+	}
+	destination := path.Join(f.chroot, zpoolCache)
+	log.Info("write zpool.cache", "path", destination)
+	err := gos.MkdirAll(path.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+	src, err := gos.Open(zpoolCache)
+	if err != nil {
+		return fmt.Errorf("unable to open %s %w", zpoolCache, err)
+	}
+	defer src.Close()
+	//nolint:gosec
+	dst, err := gos.OpenFile(destination, gos.O_CREATE|gos.O_TRUNC|gos.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create %s %w", destination, err)
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("unable to write %s %w", destination, err)
+	}
+	return nil
+}
+
+// exportZPools exports all created pools, a pool which is not exported cleanly
+// can only be imported with force by the target os.
+func (f *Filesystem) exportZPools() error {
+	for index := len(f.zpools) - 1; index >= 0; index-- {
+		pool := f.zpools[index]
+		log.Info("export zpool", "pool", pool)
+		err := os.ExecuteCommand(command.ZPool, "export", pool)
+		if err != nil {
+			return fmt.Errorf("unable to export zpool %s %w", pool, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/metal-stack/metal-hammer/metal-core/models"
+)
+
+func TestZpoolCreateArgs(t *testing.T) {
+	name := "tank"
+	tests := []struct {
+		name    string
+		pool    *models.ModelsV1ZPool
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "raidz2 with special mirror and cache",
+			pool: &models.ModelsV1ZPool{
+				Name:              &name,
+				Options:           []string{"ashift=12"},
+				Filesystemoptions: []string{"compression=lz4"},
+				Vdevs: []*models.ModelsV1ZPoolVdev{
+					{Type: "raidz2", Devices: []string{"/dev/sda", "/dev/sdb", "/dev/sdc", "/dev/sdd"}},
+					{Type: "mirror", Class: "special", Devices: []string{"/dev/nvme0n1", "/dev/nvme1n1"}},
+					{Class: "cache", Devices: []string{"/dev/nvme2n1"}},
+				},
+			},
+			want: []string{
+				"create", "-f", "-R", "/rootfs", "-o", "cachefile=/etc/zfs/zpool.cache", "-o", "ashift=12",
+				"-O", "mountpoint=none", "-O", "compression=lz4", "tank",
+				"raidz2", "/dev/sda", "/dev/sdb", "/dev/sdc", "/dev/sdd",
+				"special", "mirror", "/dev/nvme0n1", "/dev/nvme1n1",
+				"cache", "/dev/nvme2n1",
+			},
+		},
+		{
+			name: "root pool with mountpoint",
+			pool: &models.ModelsV1ZPool{
+				Name:              &name,
+				Filesystemoptions: []string{"mountpoint=/"},
+				Vdevs:             []*models.ModelsV1ZPoolVdev{{Type: "mirror", Devices: []string{"/dev/sda2", "/dev/sdb2"}}},
+			},
+			want: []string{"create", "-f", "-R", "/rootfs", "-o", "cachefile=/etc/zfs/zpool.cache", "-O", "mountpoint=/", "tank", "mirror", "/dev/sda2", "/dev/sdb2"},
+		},
+		{
+			name: "mirror with one device",
+			pool: &models.ModelsV1ZPool{
+				Name:  &name,
+				Vdevs: []*models.ModelsV1ZPoolVdev{{Type: "mirror", Devices: []string{"/dev/sda"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "only special vdev",
+			pool: &models.ModelsV1ZPool{
+				Name:  &name,
+				Vdevs: []*models.ModelsV1ZPoolVdev{{Class: "special", Devices: []string{"/dev/sda"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "mirrored cache",
+			pool: &models.ModelsV1ZPool{
+				Name: &name,
+				Vdevs: []*models.ModelsV1ZPoolVdev{
+					{Devices: []string{"/dev/sda"}},
+					{Type: "mirror", Class: "cache", Devices: []string{"/dev/sdb", "/dev/sdc"}},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := zpoolCreateArgs(tt.pool, "/rootfs")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("zpoolCreateArgs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("zpoolCreateArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDatasetMountpoints(t *testing.T) {
+	pool, root, debian, data, postgres, hidden := "rpool", "ROOT", "ROOT/debian", "data", "data/postgres", "data/hidden"
+	p := &models.ModelsV1ZPool{
+		Name: &pool,
+		Datasets: []*models.ModelsV1ZFSDataset{
+			{Name: &postgres, Properties: []string{"recordsize=16k"}},
+			{Name: &hidden, Properties: []string{"canmount=off"}},
+			{Name: &debian, Mountpoint: "/"},
+			{Name: &root},
+			{Name: &data, Mountpoint: "/var/lib/data"},
+		},
+	}
+	want := map[string]string{
+		"rpool/ROOT/debian":   "/",
+		"rpool/data":          "/var/lib/data",
+		"rpool/data/postgres": "/var/lib/data/postgres",
+	}
+	if got := datasetMountpoints(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("datasetMountpoints() = %v, want %v", got, want)
+	}
+
+	got := zfsCreateArgs(pool, p.Datasets[0])
+	wantArgs := []string{"create", "-u", "-o", "recordsize=16k", "rpool/data/postgres"}
+	if !reflect.DeepEqual(got, wantArgs) {
+		t.Errorf("zfsCreateArgs() = %v, want %v", got, wantArgs)
+	}
+}
+
+func TestCheckZFS(t *testing.T) {
+	bin := t.TempDir()
+	for _, c := range []string{"zpool", "zfs"} {
+		err := os.WriteFile(filepath.Join(bin, c), []byte("#!/bin/sh\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin)
+	defer func(m string) { zfsModule = m }(zfsModule)
+	zfsModule = filepath.Join(t.TempDir(), "zfs")
+
+	pool := "tank"
+	config := models.ModelsV1FilesystemLayoutResponse{Zpools: []*models.ModelsV1ZPool{{Name: &pool}}}
+	if err := checkZFS(models.ModelsV1FilesystemLayoutResponse{}); err != nil {
+		t.Errorf("checkZFS() of a layout without zfs error = %v", err)
+	}
+	if err := checkZFS(config); err == nil {
+		t.Errorf("checkZFS() expected error if the kernel does not provide zfs")
+	}
+	err := os.Mkdir(zfsModule, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkZFS(config); err != nil {
+		t.Errorf("checkZFS() error = %v", err)
+	}
+	os.Setenv("PATH", t.TempDir())
+	if err := checkZFS(config); err == nil {
+		t.Errorf("checkZFS() expected error if zpool is missing")
+	}
+}
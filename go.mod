@@ -5,7 +5,6 @@ go 1.16
 require (
 	github.com/beevik/ntp v0.3.0
 	github.com/cheggaaa/pb/v3 v3.0.8
-	github.com/dsnet/compress v0.0.1 // indirect
 	github.com/frankban/quicktest v1.14.3 // indirect
 	github.com/go-openapi/errors v0.20.2
 	github.com/go-openapi/runtime v0.23.3
@@ -16,27 +15,23 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/inconshreveable/log15 v0.0.0-20201112154412-8562bdadbbac
 	github.com/jaypipes/ghw v0.9.0
+	github.com/klauspost/compress v1.15.1
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/metal-stack/go-hal v0.3.6
 	github.com/metal-stack/go-lldpd v0.3.6
 	github.com/metal-stack/metal-api v0.16.4
 	github.com/metal-stack/metal-lib v0.9.0
 	github.com/metal-stack/v v1.0.3
-	// archiver must stay in version v2.1.0, see replace below
-	github.com/mholt/archiver v3.1.1+incompatible
-	github.com/nwaples/rardecode v1.1.2 // indirect
-	github.com/pierrec/lz4 v2.6.1+incompatible // indirect
 	github.com/pierrec/lz4/v4 v4.1.14
 	github.com/stretchr/testify v1.7.1
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/u-root/u-root v0.8.0
-	github.com/ulikunitz/xz v0.5.10 // indirect
+	github.com/ulikunitz/xz v0.5.10
 	github.com/vishvananda/netlink v1.1.1-0.20211118161826-650dca95af54
 	github.com/vishvananda/netns v0.0.0-20211101163701-50045581ed74 // indirect
+	golang.org/x/crypto v0.0.0-20220307211146-efcb8507fb70
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad
 	google.golang.org/grpc v1.45.0
 	gopkg.in/yaml.v2 v2.4.0
 )
-
-replace github.com/mholt/archiver => github.com/mholt/archiver v2.1.0+incompatible
@@ -18,14 +18,25 @@ import (
 
 func main() {
 	fmt.Print(cmd.HammerBanner)
-	// Reboot if metal-hammer crashes after 60sec.
-	go kernel.Watchdog()
 
 	if len(os.Args) > 1 {
-		log.Error("cmd args are not supported")
-		os.Exit(1)
+		// build-image is the only supported command, it runs the installation
+		// into disk image files on a ordinary linux machine.
+		if os.Args[1] != "build-image" {
+			log.Error("cmd args are not supported")
+			os.Exit(1)
+		}
+		err := buildImage(os.Args[2:])
+		if err != nil {
+			log.Error("build-image failed", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
+	// Reboot if metal-hammer crashes after 60sec.
+	go kernel.Watchdog()
+
 	err := updateResolvConf()
 	if err != nil {
 		log.Error("error updating resolv.conf", "error", err)
@@ -84,6 +95,14 @@ func main() {
 	}
 }
 
+func buildImage(args []string) error {
+	spec, err := cmd.NewImageBuildSpec(args)
+	if err != nil {
+		return err
+	}
+	return cmd.BuildDiskImages(spec)
+}
+
 func updateResolvConf() error {
 	// when starting the metal-hammer u-root sets a static resolv.conf file containing 8.8.8.8
 	// this can only be overwritten by running dhclient
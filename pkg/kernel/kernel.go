@@ -27,6 +27,10 @@ type Bootinfo struct {
 	Cmdline      string `yaml:"cmdline"`
 	Kernel       string `yaml:"kernel"`
 	BootloaderID string `yaml:"bootloader_id"`
+	// Slot is the root slot the os was installed into, only set for layouts with A/B root slots.
+	Slot string `yaml:"slot,omitempty"`
+	// Installed is the RFC3339 timestamp of the completed installation into the slot.
+	Installed string `yaml:"installed,omitempty"`
 }
 
 // ReadBootinfo read boot-info.yaml which was written by the OS install.sh
@@ -45,6 +49,20 @@ func ReadBootinfo(file string) (*Bootinfo, error) {
 	return info, nil
 }
 
+// WriteBootinfo writes boot-info.yaml, used to record the root slot of the installation.
+func WriteBootinfo(file string, info *Bootinfo) error {
+	bi, err := yaml.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("could not marshal boot-info.yaml %w", err)
+	}
+	//nolint:gosec
+	err = os.WriteFile(file, bi, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write boot-info.yaml %w", err)
+	}
+	return nil
+}
+
 // ParseCmdline will put each key=value pair from /proc/cmdline into a map.
 func ParseCmdline() (map[string]string, error) {
 	cmdLine, err := os.ReadFile(cmdline)
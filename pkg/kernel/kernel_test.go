@@ -69,3 +69,28 @@ func writeCmdline(content string) error {
 	}
 	return nil
 }
+
+func TestWriteBootinfo(t *testing.T) {
+	file := "/tmp/testbootinfo.yaml"
+	defer os.Remove(file)
+
+	info := &Bootinfo{
+		Kernel:       "/boot/vmlinuz",
+		Initrd:       "/boot/initrd.img",
+		Cmdline:      "console=ttyS1,115200n8",
+		BootloaderID: "metal-b",
+		Slot:         "b",
+		Installed:    "2021-04-01T10:00:00Z",
+	}
+	err := WriteBootinfo(file, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBootinfo(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *info {
+		t.Errorf("expected %v but got %v", info, got)
+	}
+}
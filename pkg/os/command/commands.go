@@ -24,6 +24,34 @@ const (
 	WIPEFS   = "wipefs"
 )
 
+// commands which are optional, disks are registered without smart data if they are missing.
+const (
+	SmartCtl = "smartctl"
+)
+
+// commands which are only required to build disk images outside of the initrd.
+const (
+	Losetup = "losetup"
+	QemuImg = "qemu-img"
+)
+
+// commands which are only required for layouts with zfs pools, the kernel must provide the zfs module as well.
+const (
+	ZFS   = "zfs"
+	ZPool = "zpool"
+)
+
+// commands which are only required for layouts with raw images whose partition is grown or with an image cache.
+const (
+	E2FSck    = "e2fsck"
+	Resize2FS = "resize2fs"
+)
+
+// commands which are only required for layouts with dm-verity protected filesystems.
+const (
+	Veritysetup = "veritysetup"
+)
+
 var commands = []string{
 	BlkID,
 	DD,